@@ -2,32 +2,136 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"github.com/AlLevykin/cutwell/internal/api/handler"
 	"github.com/AlLevykin/cutwell/internal/api/server"
 	"github.com/AlLevykin/cutwell/internal/app/pg-store"
+	"github.com/AlLevykin/cutwell/internal/app/policy"
 	"github.com/AlLevykin/cutwell/internal/app/store"
 	"github.com/AlLevykin/cutwell/internal/utils"
 	"github.com/caarlos0/env/v6"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type config struct {
-	Addr            string `env:"SERVER_ADDRESS" envDefault:"127.0.0.1:8080"`
-	BaseURL         string `env:"BASE_URL" envDefault:"127.0.0.1:8080"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	DBDSN           string `env:"DATABASE_DSN" envDefault:""`
+	Addr            string        `env:"SERVER_ADDRESS" envDefault:"127.0.0.1:8080"`
+	BaseURL         string        `env:"BASE_URL" envDefault:"127.0.0.1:8080"`
+	FileStoragePath string        `env:"FILE_STORAGE_PATH"`
+	DBDSN           string        `env:"DATABASE_DSN" envDefault:""`
+	SecretKeys      []string      `env:"SECRET_KEY" envSeparator:","`
+	CompactInterval time.Duration `env:"FILE_COMPACT_INTERVAL" envDefault:"10m"`
+	ExpireInterval  time.Duration `env:"EXPIRE_INTERVAL" envDefault:"1m"`
+	Retention       time.Duration `env:"DELETED_RETENTION" envDefault:"720h"`
+	PurgeInterval   time.Duration `env:"PURGE_INTERVAL" envDefault:"1h"`
+	// DedupScope is global, user or none, changing it rescopes the stored
+	// links of a database on the next start.
+	DedupScope     string   `env:"DEDUP_SCOPE" envDefault:"global"`
+	AllowedSchemes []string `env:"ALLOWED_SCHEMES" envSeparator:"," envDefault:"http,https"`
+	SortQuery      bool     `env:"SORT_QUERY_PARAMS" envDefault:"false"`
+	PolicyFile     string   `env:"POLICY_FILE"`
+	// Rate limits are "N/period" per client, like "60/1m", and off when
+	// empty or "0".
+	CreateLimit   string `env:"RATE_LIMIT_CREATE"`
+	BatchLimit    string `env:"RATE_LIMIT_BATCH"`
+	RedirectLimit string `env:"RATE_LIMIT_REDIRECT"`
+	SharedLimits  bool   `env:"RATE_LIMIT_SHARED" envDefault:"false"`
+	// LimitSweepInterval is how often the buckets of idle clients are
+	// dropped.
+	LimitSweepInterval time.Duration `env:"RATE_LIMIT_SWEEP_INTERVAL" envDefault:"1m"`
+	// TrustedProxies are the addresses or CIDR networks of the proxies
+	// whose X-Forwarded-For gives the client address to rate limits.
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:","`
+	// KeyStrategy is random, hash, sequential or obfuscated.
+	KeyStrategy   string `env:"KEY_STRATEGY" envDefault:"random"`
+	KeySalt       string `env:"KEY_SALT"`
+	KeyAlphabet   string `env:"KEY_ALPHABET"`
+	KeyLength     int    `env:"KEY_LENGTH" envDefault:"9"`
+	KeyMaxLength  int    `env:"KEY_MAX_LENGTH"`
+	EnableHTTPS   bool   `env:"ENABLE_HTTPS" envDefault:"false"`
+	TLSCertFile   string `env:"TLS_CERT_FILE"`
+	TLSKeyFile    string `env:"TLS_KEY_FILE"`
+	TLSMinVersion string `env:"TLS_MIN_VERSION" envDefault:"1.2"`
+	TLSCiphers    string `env:"TLS_CIPHERS" envDefault:"default"`
+	// RedirectAddr is the HTTP listener redirecting to HTTPS, "off"
+	// disables it. When empty it is port 80 of the server host, skipped
+	// when that can't be bound.
+	RedirectAddr    string        `env:"HTTP_REDIRECT_ADDRESS"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"10s"`
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY" envDefault:"0s"`
+	CheckTimeout    time.Duration `env:"READINESS_CHECK_TIMEOUT" envDefault:"2s"`
+	EnableMetrics   bool          `env:"ENABLE_METRICS" envDefault:"true"`
 }
 
-func ServeApp(ctx context.Context, wg *sync.WaitGroup, srv *server.Server) {
+// linkStore is a handler.Links with the maintenance jobs run by main.
+type linkStore interface {
+	handler.Links
+	ExpireLinks(ctx context.Context, now time.Time) (int64, error)
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// RunEvery calls job every interval until ctx is done.
+func RunEvery(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, name string, job func() error) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job(); err != nil {
+				log.Printf("%s error: %v\n", name, err)
+			}
+		}
+	}
+}
+
+// ReloadOnHangup reloads the policy every time the process gets SIGHUP until
+// ctx is done.
+func ReloadOnHangup(ctx context.Context, wg *sync.WaitGroup, p *policy.File) {
 	defer wg.Done()
-	srv.Start()
-	<-ctx.Done()
-	srv.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := p.Reload(); err != nil {
+				log.Printf("policy reload error, previous rules kept: %v\n", err)
+				continue
+			}
+			log.Println("policy reloaded")
+		}
+	}
+}
+
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
 }
 
 func main() {
@@ -39,53 +143,291 @@ func main() {
 	flag.StringVar(&cfg.BaseURL, "b", cfg.BaseURL, "base url")
 	flag.StringVar(&cfg.FileStoragePath, "f", cfg.FileStoragePath, "file storage path")
 	flag.StringVar(&cfg.DBDSN, "d", cfg.DBDSN, "database DSN")
+	flag.BoolVar(&cfg.EnableHTTPS, "s", cfg.EnableHTTPS, "serve https")
+	secretKeys := flag.String("k", strings.Join(cfg.SecretKeys, ","), "session secret keys, newest first, comma separated")
 	flag.Parse()
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	cfg.SecretKeys = splitList(*secretKeys)
+	if err := run(cfg); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// run serves until SIGINT, SIGTERM or a server error, then drains the
+// requests in flight, stops the background workers and closes the store.
+// Each step waits for ShutdownTimeout at most.
+func run(cfg config) error {
+	sig, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// ctx stops the background workers once the server is down.
+	ctx, cancelWorkers := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	stopWorkers := func() {
+		cancelWorkers()
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(cfg.ShutdownTimeout):
+			log.Println("background workers did not stop in time")
+		}
+	}
+
+	var ls linkStore
+	var limitStore handler.LimitStore
 
-	var r *handler.Router
+	if len(cfg.SecretKeys) == 0 {
+		secret, err := randomSecret()
+		if err != nil {
+			return fmt.Errorf("can't generate session secret: %w", err)
+		}
+		cfg.SecretKeys = []string{secret}
+		log.Println("SECRET_KEY is not set, sessions will not survive a restart")
+	}
+	decoder := utils.NewDecoder(cfg.SecretKeys...)
 
-	decoder := utils.NewDecoder()
+	dedup, err := handler.ParseDedupScope(cfg.DedupScope)
+	if err != nil {
+		return fmt.Errorf("DEDUP_SCOPE: %w", err)
+	}
 
+	keys, err := utils.NewKeyGenerator(utils.KeysConfig{
+		Strategy: utils.KeyStrategy(cfg.KeyStrategy),
+		RandomKeysConfig: utils.RandomKeysConfig{
+			Alphabet:  cfg.KeyAlphabet,
+			Length:    cfg.KeyLength,
+			MaxLength: cfg.KeyMaxLength,
+		},
+		Salt: cfg.KeySalt,
+	})
+	if err != nil {
+		return fmt.Errorf("key generator: %w", err)
+	}
+
+	scheme := "http"
+	if cfg.EnableHTTPS {
+		scheme = "https"
+	}
+	base, err := handler.ParseBaseURL(cfg.BaseURL, scheme)
+	if err != nil {
+		return fmt.Errorf("BASE_URL: %w", err)
+	}
+
+	var metrics *handler.Metrics
+	if cfg.EnableMetrics {
+		metrics = handler.NewMetrics()
+	}
+
+	health := handler.NewHealth(cfg.CheckTimeout)
 	if cfg.DBDSN == "" {
-		ls := store.NewLinkStore(
+		fs, err := store.NewLinkStore(
 			store.Config{
-				KeyLength: 9,
-				BaseURL:   cfg.BaseURL,
+				KeyLength: cfg.KeyLength,
+				BaseURL:   base,
+				Dedup:     dedup,
+				Keys:      keys,
+				Hooks:     metrics,
 			},
 			cfg.FileStoragePath)
-		defer func(ls *store.LinkStore) {
-			err := ls.Save()
+		if err != nil {
+			return fmt.Errorf("link store open error: %w", err)
+		}
+		defer func(fs *store.LinkStore) {
+			err := fs.Close()
 			if err != nil {
-				log.Printf("link store save error: %v\n", err)
+				log.Printf("link store close error: %v\n", err)
 			}
-		}(ls)
-		r = handler.NewRouter(ls, decoder)
+		}(fs)
+		wg.Add(1)
+		go RunEvery(ctx, wg, cfg.CompactInterval, "link store compaction", fs.Compact)
+		if cfg.SharedLimits {
+			log.Println("RATE_LIMIT_SHARED needs DATABASE_DSN, rate limits are kept in memory")
+		}
+		health.Add("file", fs.Writable)
+		ls = fs
 	} else {
-		ls := pg.NewLinkStore(
+		pgs := pg.NewLinkStore(
 			store.Config{
-				KeyLength: 9,
-				BaseURL:   cfg.BaseURL,
+				KeyLength: cfg.KeyLength,
+				BaseURL:   base,
+				Dedup:     dedup,
+				Keys:      keys,
+				Hooks:     metrics,
 			},
 			cfg.DBDSN)
-		defer ls.Close()
-		r = handler.NewRouter(ls, decoder)
+		defer pgs.Close()
+		// a store that couldn't be opened or migrated is served anyway and
+		// reported by /readyz, its links are rescoped on the next start
+		if err := pgs.Ping(ctx); err != nil {
+			log.Printf("link store is not ready, dedup scope left unchecked: %v\n", err)
+		} else {
+			n, err := pgs.Rescope(ctx)
+			if err != nil {
+				return fmt.Errorf("link store open error: %w", err)
+			}
+			if n > 0 {
+				log.Printf("%d links moved to %s dedup scope\n", n, dedup)
+			}
+		}
+		if cfg.SharedLimits {
+			limitStore = pgs
+		}
+		health.Add("migrations", pgs.Migrated)
+		if metrics != nil && pgs.DB() != nil {
+			if err := metrics.ObserveDB("cutwell", pgs.DB()); err != nil {
+				return fmt.Errorf("metrics: %w", err)
+			}
+		}
+		ls = pgs
 	}
+	// deferred after the store is, so the workers flush before it closes
+	defer stopWorkers()
+	health.Add("links", ls.Ping)
 
-	srv := server.NewServer(
-		server.Config{
-			Addr:              cfg.Addr,
-			ReadTimeout:       30 * time.Second,
-			WriteTimeout:      30 * time.Second,
-			ReadHeaderTimeout: 30 * time.Second,
-			CancelTimeout:     2 * time.Second,
-		},
-		r)
-	wg := &sync.WaitGroup{}
 	wg.Add(1)
+	go RunEvery(ctx, wg, cfg.ExpireInterval, "expired links sweep", func() error {
+		n, err := ls.ExpireLinks(ctx, time.Now())
+		if n > 0 {
+			log.Printf("%d expired links removed\n", n)
+		}
+		return err
+	})
 
-	go ServeApp(ctx, wg, srv)
+	wg.Add(1)
+	go RunEvery(ctx, wg, cfg.PurgeInterval, "deleted links purge", func() error {
+		n, err := ls.Purge(ctx, time.Now().Add(-cfg.Retention))
+		if n > 0 {
+			log.Printf("%d deleted links purged\n", n)
+		}
+		return err
+	})
 
-	<-ctx.Done()
-	cancel()
-	wg.Wait()
+	clicks := handler.NewClickRecorder(ls, handler.ClickRecorderConfig{
+		Salt:          cfg.SecretKeys[0],
+		QueueSize:     10000,
+		BatchSize:     100,
+		FlushInterval: time.Second,
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		clicks.Run(ctx)
+	}()
+	health.Add("clicks", clicks.Check)
+
+	deletes := handler.NewDeleteQueue(ls, handler.DeleteQueueConfig{
+		QueueSize:     1000,
+		BatchSize:     500,
+		FlushInterval: time.Second,
+		JobRetention:  time.Hour,
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		deletes.Run(ctx)
+	}()
+	health.Add("deletes", deletes.Check)
+	if metrics != nil {
+		if err := metrics.ObserveDeleteQueue(deletes); err != nil {
+			return fmt.Errorf("metrics: %w", err)
+		}
+	}
+
+	limits := handler.RateLimitConfig{Store: limitStore}
+	if limits.TrustedProxies, err = handler.ParseProxies(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	for _, l := range []struct {
+		name  string
+		value string
+		limit *handler.Limit
+	}{
+		{"RATE_LIMIT_CREATE", cfg.CreateLimit, &limits.Create},
+		{"RATE_LIMIT_BATCH", cfg.BatchLimit, &limits.Batch},
+		{"RATE_LIMIT_REDIRECT", cfg.RedirectLimit, &limits.Redirect},
+	} {
+		if *l.limit, err = handler.ParseLimit(l.value); err != nil {
+			return fmt.Errorf("%s: %w", l.name, err)
+		}
+	}
+	limiter := handler.NewRateLimiter(limits)
+	wg.Add(1)
+	go RunEvery(ctx, wg, cfg.LimitSweepInterval, "rate limits sweep", func() error {
+		_, err := limiter.Forget(ctx, time.Now())
+		return err
+	})
+
+	opts := []handler.Option{
+		handler.WithPrefix(base.Prefix),
+		handler.WithHealth(health),
+		handler.WithMetrics(metrics),
+		handler.WithRateLimiter(limiter),
+		handler.WithClickRecorder(clicks),
+		handler.WithDeleteQueue(deletes),
+		handler.WithRetention(cfg.Retention),
+		handler.WithNormalizer(handler.NewNormalizer(handler.NormalizerConfig{
+			Schemes:   cfg.AllowedSchemes,
+			SortQuery: cfg.SortQuery,
+		})),
+	}
+	if cfg.PolicyFile != "" {
+		p, err := policy.Open(cfg.PolicyFile)
+		if err != nil {
+			return fmt.Errorf("policy open error: %w", err)
+		}
+		wg.Add(1)
+		go ReloadOnHangup(ctx, wg, p)
+		opts = append(opts, handler.WithPolicy(p))
+	}
+
+	r := handler.NewRouter(ls, decoder, opts...)
+
+	srvCfg := server.Config{
+		Addr:              cfg.Addr,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if cfg.EnableHTTPS {
+		srvCfg.TLS = &server.TLSConfig{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			SelfSigned:   cfg.TLSCertFile == "" && cfg.TLSKeyFile == "",
+			MinVersion:   cfg.TLSMinVersion,
+			Ciphers:      cfg.TLSCiphers,
+			RedirectAddr: cfg.RedirectAddr,
+		}
+		if srvCfg.TLS.SelfSigned {
+			log.Println("TLS_CERT_FILE is not set, serving a self-signed certificate")
+		}
+	}
+	srv, err := server.NewServer(srvCfg, r)
+	if err != nil {
+		return fmt.Errorf("server config error: %w", err)
+	}
+
+	if err = srv.Start(); err == nil {
+		log.Printf("listening on %s://%s\n", srv.Scheme(), srv.Addr())
+		select {
+		case <-sig.Done():
+			log.Println("shutting down")
+		case err = <-srv.Errors():
+			log.Printf("%v, shutting down\n", err)
+		}
+	}
+
+	// readyz fails from now on, the delay lets load balancers notice before
+	// the listener closes
+	health.Drain()
+	if err == nil && cfg.ShutdownDelay > 0 {
+		time.Sleep(cfg.ShutdownDelay)
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if serr := srv.Stop(shutdown); serr != nil {
+		log.Printf("%v\n", serr)
+	}
+	return err
 }
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	MinAliasLength = 3
+	MaxAliasLength = 64
+)
+
+// reservedAliases are the first path segments served by the router itself,
+// a link stored under one of them would never be reachable.
+var reservedAliases = map[string]bool{
+	"api":     true,
+	"ping":    true,
+	"healthz": true,
+	"readyz":  true,
+	"metrics": true,
+}
+
+func isAliasRune(r rune) bool {
+	return r >= 'a' && r <= 'z' ||
+		r >= 'A' && r <= 'Z' ||
+		r >= '0' && r <= '9' ||
+		r == '-' || r == '_'
+}
+
+// ValidateAlias checks that alias can be used as a link key: it must be
+// MinAliasLength to MaxAliasLength letters, digits, dashes or underscores
+// long and must not clash with a reserved path.
+func ValidateAlias(alias string) error {
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return fmt.Errorf("%w: %q must be %d to %d characters long", ErrInvalidAlias, alias, MinAliasLength, MaxAliasLength)
+	}
+	if strings.IndexFunc(alias, func(r rune) bool { return !isAliasRune(r) }) != -1 {
+		return fmt.Errorf("%w: %q may only contain letters, digits, '-' and '_'", ErrInvalidAlias, alias)
+	}
+	if ReservedKey(alias) {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
+// ReservedKey reports whether key clashes with a path served by the router,
+// stores skip such generated keys.
+func ReservedKey(key string) bool {
+	return reservedAliases[strings.ToLower(key)]
+}
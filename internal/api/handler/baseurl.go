@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// BaseURL is the root of short urls: a scheme, a host and the path prefix
+// the service is mounted under.
+type BaseURL struct {
+	Scheme string
+	Host   string
+	// Prefix is empty or a path starting with a slash and without a
+	// trailing one.
+	Prefix string
+}
+
+// ParseBaseURL parses raw, a url or a bare host with an optional port and
+// path. scheme is used when raw has none.
+func ParseBaseURL(raw, scheme string) (BaseURL, error) {
+	s := strings.TrimSpace(raw)
+	if !strings.Contains(s, "://") {
+		s = scheme + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return BaseURL{}, fmt.Errorf("invalid base url %q: %w", raw, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return BaseURL{}, fmt.Errorf("invalid base url %q: scheme must be http or https", raw)
+	case u.Host == "":
+		return BaseURL{}, fmt.Errorf("invalid base url %q: no host", raw)
+	case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return BaseURL{}, fmt.Errorf("invalid base url %q: only a path may follow the host", raw)
+	}
+	return BaseURL{
+		Scheme: u.Scheme,
+		Host:   strings.ToLower(u.Host),
+		Prefix: strings.TrimRight(u.Path, "/"),
+	}, nil
+}
+
+// ShortURL returns the short url of key.
+func (b BaseURL) ShortURL(key string) string {
+	u := url.URL{Scheme: b.Scheme, Host: b.Host, Path: b.Prefix + "/" + key}
+	return u.String()
+}
+
+func (b BaseURL) String() string {
+	u := url.URL{Scheme: b.Scheme, Host: b.Host, Path: b.Prefix}
+	return u.String()
+}
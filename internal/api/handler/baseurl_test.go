@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseBaseURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		scheme  string
+		want    BaseURL
+		wantErr bool
+	}{
+		{"host", "127.0.0.1:8080", "http", BaseURL{"http", "127.0.0.1:8080", ""}, false},
+		{"default scheme", "localhost:8443", "https", BaseURL{"https", "localhost:8443", ""}, false},
+		{"scheme kept", "HTTPS://Go.Example.com", "http", BaseURL{"https", "go.example.com", ""}, false},
+		{"prefix", "https://go.example.com/s/", "http", BaseURL{"https", "go.example.com", "/s"}, false},
+		{"bare prefix", "go.example.com/a/b", "http", BaseURL{"http", "go.example.com", "/a/b"}, false},
+		{"no host", "https:///s", "http", BaseURL{}, true},
+		{"scheme", "ftp://go.example.com", "http", BaseURL{}, true},
+		{"query", "https://go.example.com/?a=b", "http", BaseURL{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBaseURL(tt.raw, tt.scheme)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBaseURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBaseURL() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseURL_ShortURL(t *testing.T) {
+	tests := []struct {
+		base BaseURL
+		want string
+	}{
+		{BaseURL{"http", "127.0.0.1:8080", ""}, "http://127.0.0.1:8080/key"},
+		{BaseURL{"https", "go.example.com", "/s"}, "https://go.example.com/s/key"},
+	}
+	for _, tt := range tests {
+		if got := tt.base.ShortURL("key"); got != tt.want {
+			t.Errorf("ShortURL() = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestRouter_Prefix(t *testing.T) {
+	r := NewRouter(&limitLinks{}, utils.NewDecoder("secret"), WithPrefix("/s/"))
+	tests := []struct {
+		name   string
+		method string
+		target string
+		want   int
+	}{
+		{"create", http.MethodPost, "/s/", http.StatusCreated},
+		{"shorten", http.MethodPost, "/s/api/shorten", http.StatusCreated},
+		{"redirect", http.MethodGet, "/s/key", http.StatusTemporaryRedirect},
+		{"outside prefix", http.MethodGet, "/key", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := "http://ya.ru"
+			if strings.HasSuffix(tt.target, "shorten") {
+				body = `{"url":"http://ya.ru"}`
+			}
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			if tt.method == http.MethodPost {
+				cookies := w.Result().Cookies()
+				if len(cookies) != 1 || cookies[0].Path != "/s/" {
+					t.Errorf("got cookies %v, want a session cookie of path /s/", cookies)
+				}
+			}
+		})
+	}
+}
+
+func TestRouter_PrefixDeletionLocation(t *testing.T) {
+	dq := NewDeleteQueue(&deleteLinks{deleted: make(map[string][]string)}, DeleteQueueConfig{QueueSize: 1, BatchSize: 10})
+	r := NewRouter(&limitLinks{}, utils.NewDecoder("secret"), WithPrefix("/s"), WithDeleteQueue(dq))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/s/api/user/urls", strings.NewReader(`["key"]`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("DELETE got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/s/api/user/deletions/") {
+		t.Fatalf("DELETE got Location %q, want it under /s", location)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, location, nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET %s got status %d, want %d", location, w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type Click struct {
+	Key       string
+	At        time.Time
+	Referrer  string
+	UserAgent string
+	IPHash    string
+}
+
+type Stats struct {
+	Total int64 `json:"total"`
+	// Visitors is the number of distinct client address hashes.
+	Visitors   int64            `json:"unique_visitors"`
+	Daily      []DailyClicks    `json:"daily"`
+	Referrers  []ReferrerCount  `json:"top_referrers"`
+	UserAgents []UserAgentCount `json:"top_user_agents"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+type ReferrerCount struct {
+	Referrer string `json:"referrer"`
+	Clicks   int64  `json:"clicks"`
+}
+
+type UserAgentCount struct {
+	UserAgent string `json:"user_agent"`
+	Clicks    int64  `json:"clicks"`
+}
+
+const (
+	// StatsDateLayout is the layout of DailyClicks.Date, days are UTC.
+	StatsDateLayout = "2006-01-02"
+	// TopReferrers also limits the user agents of Stats.
+	TopReferrers = 10
+)
+
+type ClickRecorderConfig struct {
+	// Salt is hashed with client addresses.
+	Salt          string
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// ClickRecorder keeps the writes of clicks off the redirect path.
+type ClickRecorder struct {
+	ls    Links
+	cfg   ClickRecorderConfig
+	queue chan Click
+	alive heartbeat
+}
+
+func NewClickRecorder(ls Links, c ClickRecorderConfig) *ClickRecorder {
+	return &ClickRecorder{
+		ls:    ls,
+		cfg:   c,
+		queue: make(chan Click, c.QueueSize),
+	}
+}
+
+// Track never blocks, it drops the click when the queue is full.
+func (cr *ClickRecorder) Track(key string, req *http.Request) {
+	click := Click{
+		Key:       key,
+		At:        time.Now().UTC(),
+		Referrer:  referrerHost(req.Referer()),
+		UserAgent: req.UserAgent(),
+		IPHash:    cr.hashIP(req.RemoteAddr),
+	}
+	select {
+	case cr.queue <- click:
+	default:
+		log.Printf("click recorder: queue is full, click on %s dropped\n", key)
+	}
+}
+
+func referrerHost(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (cr *ClickRecorder) hashIP(addr string) string {
+	sum := sha256.Sum256([]byte(cr.cfg.Salt + clientIP(addr)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Run writes the queued clicks every FlushInterval or in batches of
+// BatchSize. The clicks still queued when ctx is done are written before it
+// returns, within a FlushInterval.
+func (cr *ClickRecorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(cr.cfg.FlushInterval)
+	defer ticker.Stop()
+	cr.alive.beat(time.Now())
+	defer cr.alive.stop()
+
+	batch := make([]Click, 0, cr.cfg.BatchSize)
+	for {
+		select {
+		case click := <-cr.queue:
+			batch = append(batch, click)
+			if len(batch) >= cr.cfg.BatchSize {
+				batch = cr.flush(ctx, batch)
+			}
+		case <-ticker.C:
+			batch = cr.flush(ctx, batch)
+			cr.alive.beat(time.Now())
+		case <-ctx.Done():
+			for len(cr.queue) > 0 {
+				batch = append(batch, <-cr.queue)
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), cr.cfg.FlushInterval)
+			cr.flush(flushCtx, batch)
+			cancel()
+			return
+		}
+	}
+}
+
+// Check fails when clicks aren't written: Run has stopped or is stuck in
+// the store.
+func (cr *ClickRecorder) Check(ctx context.Context) error {
+	return cr.alive.check(cr.cfg.FlushInterval, time.Now())
+}
+
+func (cr *ClickRecorder) flush(ctx context.Context, batch []Click) []Click {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := cr.ls.RecordClicks(ctx, batch); err != nil {
+		log.Printf("click recorder: %d clicks lost: %v\n", len(batch), err)
+	}
+	return batch[:0]
+}
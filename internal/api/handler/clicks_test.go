@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clickLinks struct {
+	Links
+	mu     sync.Mutex
+	clicks []Click
+}
+
+func (l *clickLinks) RecordClicks(ctx context.Context, clicks []Click) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clicks = append(l.clicks, clicks...)
+	return nil
+}
+
+func TestClickRecorder_Run(t *testing.T) {
+	ls := &clickLinks{}
+	cr := NewClickRecorder(ls, ClickRecorderConfig{
+		Salt:          "salt",
+		QueueSize:     10,
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+	})
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/key", nil)
+		req.Header.Set("Referer", "https://google.com/search?q=cutwell")
+		req.RemoteAddr = "192.0.2.1:1234"
+		cr.Track("key", req)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cr.Run(ctx)
+
+	if len(ls.clicks) != 3 {
+		t.Fatalf("Run() recorded %d clicks, want 3", len(ls.clicks))
+	}
+	c := ls.clicks[0]
+	if c.Key != "key" || c.Referrer != "google.com" {
+		t.Errorf("Run() recorded %+v", c)
+	}
+	if c.IPHash == "" || c.IPHash == "192.0.2.1" || c.IPHash != ls.clicks[1].IPHash {
+		t.Errorf("Run() recorded address hash %q", c.IPHash)
+	}
+}
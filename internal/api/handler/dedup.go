@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DedupScope tells link stores which links are duplicates of each other.
+type DedupScope string
+
+const (
+	// DedupGlobal stores every url once, whoever shortens it.
+	DedupGlobal DedupScope = "global"
+	// DedupUser stores every url once per user.
+	DedupUser DedupScope = "user"
+	// DedupNone stores every shortened url, even a repeated one.
+	DedupNone DedupScope = "none"
+)
+
+// ParseDedupScope parses a scope name, the empty name is DedupGlobal.
+func ParseDedupScope(s string) (DedupScope, error) {
+	switch scope := DedupScope(strings.ToLower(s)); scope {
+	case "":
+		return DedupGlobal, nil
+	case DedupGlobal, DedupUser, DedupNone:
+		return scope, nil
+	}
+	return "", fmt.Errorf("unknown dedup scope %q, want global, user or none", s)
+}
+
+// CanonicalURL returns the form of lnk used to detect duplicates. Scheme and
+// host are case-insensitive and are lowercased; path, query and fragment are
+// compared as they are.
+func CanonicalURL(lnk string) string {
+	u, err := url.Parse(lnk)
+	if err != nil || u.Opaque != "" {
+		return lnk
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
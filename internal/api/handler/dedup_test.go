@@ -0,0 +1,48 @@
+package handler
+
+import "testing"
+
+func TestParseDedupScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    DedupScope
+		wantErr bool
+	}{
+		{"default", "", DedupGlobal, false},
+		{"user", "user", DedupUser, false},
+		{"case", "NONE", DedupNone, false},
+		{"unknown", "tenant", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDedupScope(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDedupScope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDedupScope() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		name string
+		lnk  string
+		want string
+	}{
+		{"lowercase", "http://ya.ru/maps", "http://ya.ru/maps"},
+		{"scheme and host", "HTTP://YA.RU/Maps?Q=Moscow#Top", "http://ya.ru/Maps?Q=Moscow#Top"},
+		{"no scheme", "Ya.ru/Maps", "Ya.ru/Maps"},
+		{"opaque", "mailto:Admin@Ya.ru", "mailto:Admin@Ya.ru"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanonicalURL(tt.lnk); got != tt.want {
+				t.Errorf("CanonicalURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"context"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+type DeleteOutcome string
+
+const (
+	OutcomeDeleted  DeleteOutcome = "deleted"
+	OutcomeRestored DeleteOutcome = "restored"
+	OutcomeNotFound DeleteOutcome = "not_found"
+	OutcomeNotOwned DeleteOutcome = "not_owned"
+	OutcomeExpired  DeleteOutcome = "expired"
+	// OutcomeConflict is a link that can't be restored, its url was
+	// shortened again.
+	OutcomeConflict DeleteOutcome = "conflict"
+)
+
+const DefaultRetention = 30 * 24 * time.Hour
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+type DeletionJob struct {
+	ID     string                   `json:"id"`
+	Status JobStatus                `json:"status"`
+	Keys   map[string]DeleteOutcome `json:"keys,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+
+	user     string
+	finished time.Time
+}
+
+type Deletion struct {
+	Job  string
+	User string
+	Keys []string
+}
+
+const jobIDLength = 16
+
+type DeleteQueueConfig struct {
+	QueueSize int
+	// BatchSize counts the keys of all users.
+	BatchSize     int
+	FlushInterval time.Duration
+	JobRetention  time.Duration
+}
+
+// DeleteQueue deletes links in the background, batching the deletions
+// requested by many users together. Jobs are kept in memory only, so
+// /api/user/deletions/{id} answers 404 for the jobs of an instance that
+// restarted, and the deletions still queued when it crashed are lost.
+type DeleteQueue struct {
+	ls    Links
+	cfg   DeleteQueueConfig
+	queue chan Deletion
+	alive heartbeat
+
+	mu   sync.Mutex
+	jobs map[string]*DeletionJob
+}
+
+func NewDeleteQueue(ls Links, c DeleteQueueConfig) *DeleteQueue {
+	return &DeleteQueue{
+		ls:    ls,
+		cfg:   c,
+		queue: make(chan Deletion, c.QueueSize),
+		jobs:  make(map[string]*DeletionJob),
+	}
+}
+
+// Enqueue never blocks, it returns ErrQueueFull when the queue is full.
+func (dq *DeleteQueue) Enqueue(user string, keys []string) (string, error) {
+	dq.mu.Lock()
+	id := utils.RandString(jobIDLength)
+	for _, ok := dq.jobs[id]; ok; _, ok = dq.jobs[id] {
+		id = utils.RandString(jobIDLength)
+	}
+	dq.jobs[id] = &DeletionJob{ID: id, Status: JobPending, user: user}
+	dq.mu.Unlock()
+
+	select {
+	case dq.queue <- Deletion{Job: id, User: user, Keys: keys}:
+		return id, nil
+	default:
+		dq.mu.Lock()
+		delete(dq.jobs, id)
+		dq.mu.Unlock()
+		return "", ErrQueueFull
+	}
+}
+
+// Job reports the jobs of other users as not found.
+func (dq *DeleteQueue) Job(id, user string) (DeletionJob, error) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+
+	job, ok := dq.jobs[id]
+	if !ok || job.user != user {
+		return DeletionJob{}, ErrNotFound
+	}
+	return *job, nil
+}
+
+// Run deletes the links of all queued deletions at once, every
+// FlushInterval or when BatchSize keys are queued. Deletions still queued
+// when ctx is done are deleted before it returns.
+func (dq *DeleteQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(dq.cfg.FlushInterval)
+	defer ticker.Stop()
+	dq.alive.beat(time.Now())
+	defer dq.alive.stop()
+
+	var batch []Deletion
+	var size int
+	for {
+		select {
+		case d := <-dq.queue:
+			batch = append(batch, d)
+			size += len(d.Keys)
+			if size >= dq.cfg.BatchSize {
+				batch, size = dq.flush(ctx, batch), 0
+			}
+		case <-ticker.C:
+			batch, size = dq.flush(ctx, batch), 0
+			dq.forget(time.Now())
+			dq.alive.beat(time.Now())
+		case <-ctx.Done():
+			for len(dq.queue) > 0 {
+				batch = append(batch, <-dq.queue)
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), dq.cfg.FlushInterval)
+			dq.flush(flushCtx, batch)
+			cancel()
+			return
+		}
+	}
+}
+
+// Check fails when Run has stopped or hasn't flushed in a FlushInterval.
+func (dq *DeleteQueue) Check(ctx context.Context) error {
+	return dq.alive.check(dq.cfg.FlushInterval, time.Now())
+}
+
+// flush retries a failed batch deletion by deletion, so that a single bad
+// deletion doesn't fail the jobs of other users.
+func (dq *DeleteQueue) flush(ctx context.Context, batch []Deletion) []Deletion {
+	if len(batch) == 0 {
+		return batch
+	}
+	outcomes, err := dq.ls.DeleteBatch(ctx, batch)
+	if err == nil || len(batch) == 1 {
+		dq.finish(batch, outcomes, err)
+		return batch[:0]
+	}
+	log.Printf("delete queue: batch of %d deletions failed, retrying them one by one: %v\n", len(batch), err)
+	for _, d := range batch {
+		one := []Deletion{d}
+		outcomes, err := dq.ls.DeleteBatch(ctx, one)
+		dq.finish(one, outcomes, err)
+	}
+	return batch[:0]
+}
+
+func (dq *DeleteQueue) finish(deletions []Deletion, outcomes map[string]map[string]DeleteOutcome, err error) {
+	if err != nil {
+		log.Printf("delete queue: %d deletions not done: %v\n", len(deletions), err)
+	}
+
+	now := time.Now()
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	for _, d := range deletions {
+		job, ok := dq.jobs[d.Job]
+		if !ok {
+			continue
+		}
+		job.finished = now
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			continue
+		}
+		job.Status = JobDone
+		job.Keys = make(map[string]DeleteOutcome, len(d.Keys))
+		for _, key := range d.Keys {
+			job.Keys[key] = outcomes[d.User][key]
+		}
+	}
+}
+
+func (dq *DeleteQueue) forget(now time.Time) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+
+	for id, job := range dq.jobs {
+		if job.Status != JobPending && now.Sub(job.finished) > dq.cfg.JobRetention {
+			delete(dq.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type deleteLinks struct {
+	Links
+	mu      sync.Mutex
+	calls   int
+	deleted map[string][]string
+}
+
+func (l *deleteLinks) DeleteBatch(ctx context.Context, batch []Deletion) (map[string]map[string]DeleteOutcome, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls++
+	res := make(map[string]map[string]DeleteOutcome)
+	for _, d := range batch {
+		if d.User == "broken" {
+			return nil, io.ErrUnexpectedEOF
+		}
+		l.deleted[d.User] = append(l.deleted[d.User], d.Keys...)
+		if res[d.User] == nil {
+			res[d.User] = map[string]DeleteOutcome{"b": OutcomeNotOwned}
+		}
+		for _, key := range d.Keys {
+			if key != "b" {
+				res[d.User][key] = OutcomeDeleted
+			}
+		}
+	}
+	return res, nil
+}
+
+func TestDeleteQueue_Run(t *testing.T) {
+	ls := &deleteLinks{deleted: make(map[string][]string)}
+	dq := NewDeleteQueue(ls, DeleteQueueConfig{
+		QueueSize:     3,
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+	})
+	var jobs []string
+	for _, d := range []Deletion{
+		{User: "000001", Keys: []string{"a", "b"}},
+		{User: "000002", Keys: []string{"c"}},
+		{User: "000001", Keys: []string{"d"}},
+	} {
+		id, err := dq.Enqueue(d.User, d.Keys)
+		if err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+		jobs = append(jobs, id)
+	}
+	if _, err := dq.Enqueue("000003", []string{"f"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue() to full queue error = %v, want %v", err, ErrQueueFull)
+	}
+	if job, err := dq.Job(jobs[0], "000001"); err != nil || job.Status != JobPending {
+		t.Errorf("Job() before Run = %+v, %v, want pending", job, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dq.Run(ctx)
+
+	want := map[string][]string{
+		"000001": {"a", "b", "d"},
+		"000002": {"c"},
+	}
+	if !reflect.DeepEqual(ls.deleted, want) {
+		t.Errorf("Run() deleted %v, want %v", ls.deleted, want)
+	}
+	if ls.calls != 1 {
+		t.Errorf("Run() made %d DeleteBatch calls, want one for all users", ls.calls)
+	}
+
+	job, err := dq.Job(jobs[0], "000001")
+	wantKeys := map[string]DeleteOutcome{"a": OutcomeDeleted, "b": OutcomeNotOwned}
+	if err != nil || job.Status != JobDone || !reflect.DeepEqual(job.Keys, wantKeys) {
+		t.Errorf("Job() = %+v, %v, want done with %v", job, err, wantKeys)
+	}
+	if _, err := dq.Job(jobs[0], "000002"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Job() of other user error = %v, want %v", err, ErrNotFound)
+	}
+
+	dq.forget(time.Now().Add(time.Minute))
+	if _, err := dq.Job(jobs[0], "000001"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Job() after retention error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDeleteQueue_RunFailed(t *testing.T) {
+	ls := &deleteLinks{deleted: make(map[string][]string)}
+	dq := NewDeleteQueue(ls, DeleteQueueConfig{
+		QueueSize:     2,
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+	})
+	ok, err := dq.Enqueue("000001", []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := dq.Enqueue("broken", []string{"e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dq.Run(ctx)
+
+	// the failed batch is retried deletion by deletion, so only the job
+	// whose own deletion fails is failed
+	if ls.calls != 3 {
+		t.Errorf("Run() made %d DeleteBatch calls, want the batch and a retry per deletion", ls.calls)
+	}
+	if job, err := dq.Job(ok, "000001"); err != nil || job.Status != JobDone || job.Keys["a"] != OutcomeDeleted {
+		t.Errorf("Job() of 000001 = %+v, %v, want done", job, err)
+	}
+	if job, err := dq.Job(broken, "broken"); err != nil || job.Status != JobFailed || job.Error == "" {
+		t.Errorf("Job() of broken = %+v, %v, want failed", job, err)
+	}
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by Links implementations. Handlers map them to status
+// codes, so backends must wrap their driver errors into one of these.
+var (
+	ErrNotFound   = errors.New("link not found")
+	ErrConflict   = errors.New("link already exists")
+	ErrGone       = errors.New("link deleted")
+	ErrInvalidURL = errors.New("invalid url")
+	ErrForbidden  = errors.New("forbidden")
+
+	ErrInvalidAlias  = errors.New("invalid alias")
+	ErrAliasTaken    = errors.New("alias is taken")
+	ErrInvalidExpiry = errors.New("invalid expiration")
+	ErrInvalidQuery  = errors.New("invalid query")
+
+	ErrQueueFull = errors.New("queue is full, try again later")
+	ErrBlocked   = errors.New("url is blocked")
+)
+
+// ConflictError reports that the link is already stored under Key.
+type ConflictError struct {
+	Key string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrConflict, e.Key)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// errorStatus returns the status code for err, or fallback when err is not
+// one of the domain errors.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrAliasTaken):
+		return http.StatusConflict
+	case errors.Is(err, ErrGone):
+		return http.StatusGone
+	case errors.Is(err, ErrInvalidURL), errors.Is(err, ErrInvalidAlias), errors.Is(err, ErrInvalidExpiry),
+		errors.Is(err, ErrInvalidQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrQueueFull):
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+// httpError replies to the request with err and status. A *URLError is
+// sent as JSON, so that clients can tell which url was rejected and why.
+func httpError(w http.ResponseWriter, err error, status int) {
+	var urlErr *URLError
+	if !errors.As(err, &urlErr) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cause := ErrInvalidURL
+	if urlErr.Err != nil {
+		cause = urlErr.Err
+	}
+	body, err := json.Marshal(struct {
+		Error string `json:"error"`
+		*URLError
+	}{cause.Error(), urlErr})
+	if err != nil {
+		http.Error(w, urlErr.Error(), status)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -3,35 +3,56 @@ package handler
 import (
 	"compress/gzip"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/AlLevykin/cutwell/internal/utils"
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgerrcode"
-	"github.com/lib/pq"
 	"io"
 	"net/http"
-	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ContextKey string
 
+const SessionCookie = "cutwell-session"
+
 type Links interface {
-	Host() string
-	Create(ctx context.Context, lnk string, user string) (string, error)
+	// ShortURL returns the short url of key.
+	ShortURL(key string) string
+	Create(ctx context.Context, lnk Link, user string) (string, error)
 	Get(ctx context.Context, key string) (string, error)
-	GetURLList(ctx context.Context, user string) ([]Item, error)
+	// GetURLList returns a page of the links of user and the cursor of the
+	// next page, which is nil on the last page.
+	GetURLList(ctx context.Context, user string, q ListQuery) ([]Item, *Cursor, error)
 	Ping(ctx context.Context) error
 	Batch(ctx context.Context, batch []BatchItem, user string) ([]ResultItem, error)
-	Find(ctx context.Context, lnk string) (string, error)
-	Delete(ctx context.Context, urls []string, user string) error
+	// Find returns the key of the link lnk of user is a duplicate of.
+	Find(ctx context.Context, lnk string, user string) (string, error)
+	// Delete removes the links of user with the given keys and reports the
+	// outcome for every key.
+	Delete(ctx context.Context, urls []string, user string) (map[string]DeleteOutcome, error)
+	// DeleteBatch removes the links of deletions of any users at once and
+	// reports the outcome for every key by user.
+	DeleteBatch(ctx context.Context, batch []Deletion) (map[string]map[string]DeleteOutcome, error)
+	// Restore undoes the deletion of the links of user deleted at or after
+	// since and reports the outcome for every key.
+	Restore(ctx context.Context, urls []string, user string, since time.Time) (map[string]DeleteOutcome, error)
+	RecordClicks(ctx context.Context, clicks []Click) error
+	Stats(ctx context.Context, key string, user string, since time.Time) (*Stats, error)
 }
 
+// Link is the body of a shorten request. The link expires either at
+// ExpiresAt or TTL seconds after it is created; handlers resolve TTL into
+// ExpiresAt, so Links implementations only look at ExpiresAt.
 type Link struct {
-	URL string `json:"url"`
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
 }
 
 type ShortenLink struct {
@@ -39,13 +60,23 @@ type ShortenLink struct {
 }
 
 type Item struct {
-	ShortURL string `json:"short_url"`
-	URL      string `json:"original_url"`
+	Key       string     `json:"-"`
+	ShortURL  string     `json:"short_url"`
+	URL       string     `json:"original_url"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Deleted is set for deleted and expired links, which are listed only
+	// on request. DeletedAt is the time of deletion or expiration.
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type BatchItem struct {
-	ID  string `json:"correlation_id"`
-	URL string `json:"original_url"`
+	ID        string     `json:"correlation_id"`
+	URL       string     `json:"original_url"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
 }
 
 type ResultItem struct {
@@ -57,44 +88,202 @@ type Router struct {
 	*chi.Mux
 	ls      Links
 	decoder *utils.Decoder
+	clicks  *ClickRecorder
+	deletes *DeleteQueue
+	// retention is how long deleted links can be restored.
+	retention  time.Duration
+	normalizer *Normalizer
+	policy     Policy
+	limits     *RateLimiter
+	// prefix is the path the routes are mounted under.
+	prefix  string
+	health  *Health
+	metrics *Metrics
+}
+
+// Option configures optional Router features.
+type Option func(r *Router)
+
+// WithClickRecorder makes the router track every redirect with cr.
+func WithClickRecorder(cr *ClickRecorder) Option {
+	return func(r *Router) {
+		r.clicks = cr
+	}
+}
+
+// WithDeleteQueue makes the router delete links in the background with dq
+// instead of within the request.
+func WithDeleteQueue(dq *DeleteQueue) Option {
+	return func(r *Router) {
+		r.deletes = dq
+	}
+}
+
+// WithRetention sets how long deleted links can be restored, it should
+// match the retention of the purge job.
+func WithRetention(d time.Duration) Option {
+	return func(r *Router) {
+		r.retention = d
+	}
+}
+
+// WithNormalizer sets the validation and normalization of shortened urls.
+func WithNormalizer(n *Normalizer) Option {
+	return func(r *Router) {
+		r.normalizer = n
+	}
+}
+
+// WithPolicy makes the router refuse to shorten and to follow links to the
+// hosts blocked by p.
+func WithPolicy(p Policy) Option {
+	return func(r *Router) {
+		r.policy = p
+	}
+}
+
+// WithRateLimiter makes the router limit how fast clients create links and
+// follow them.
+func WithRateLimiter(rl *RateLimiter) Option {
+	return func(r *Router) {
+		r.limits = rl
+	}
 }
 
-func NewRouter(ls Links, d *utils.Decoder) *Router {
+// WithPrefix mounts the routes under prefix, the path of the base url, so
+// the service can run behind a path routing proxy.
+func WithPrefix(prefix string) Option {
+	return func(r *Router) {
+		r.prefix = strings.TrimRight(prefix, "/")
+	}
+}
+
+// WithHealth sets the checks of the readiness probe, the Ping of the store
+// only when not set.
+func WithHealth(h *Health) Option {
+	return func(r *Router) {
+		r.health = h
+	}
+}
+
+// WithMetrics makes the router count requests into m and serve them on
+// /metrics.
+func WithMetrics(m *Metrics) Option {
+	return func(r *Router) {
+		r.metrics = m
+	}
+}
+
+func NewRouter(ls Links, d *utils.Decoder, opts ...Option) *Router {
 	r := &Router{
-		Mux:     chi.NewRouter(),
-		ls:      ls,
-		decoder: d,
-	}
-	r.Get("/{key}", r.Redirect)
-	r.With(r.CheckSession, r.ReadBody, r.GetShortLink, r.Compress).Post("/", r.SendPlainText)
-	r.With(r.CheckSession, r.ReadBody, r.UnmarshalData, r.GetShortLink, r.MarshalData, r.Compress).Post("/api/shorten", r.SendJSON)
-	r.With(r.CheckSession, r.GetUrls, r.Compress).Get("/api/user/urls", r.SendJSON)
-	r.Get("/ping", r.Ping)
-	r.With(r.CheckSession, r.ReadBody, r.Batch, r.Compress).Post("/api/shorten/batch", r.SendJSON)
-	r.With(r.CheckSession, r.ReadBody).Delete("/api/user/urls", r.DeleteUrls)
+		Mux:        chi.NewRouter(),
+		ls:         ls,
+		decoder:    d,
+		retention:  DefaultRetention,
+		normalizer: NewNormalizer(NormalizerConfig{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.health == nil {
+		r.health = NewHealth(DefaultCheckTimeout)
+		r.health.Add("links", func(ctx context.Context) error {
+			return r.ls.Ping(ctx)
+		})
+	}
+	r.Use(r.Instrument)
+	// probes and scrapes reach the pod directly, they are served outside
+	// the prefix
+	r.Get("/healthz", r.Healthz)
+	r.Get("/readyz", r.Readyz)
+	if r.metrics != nil {
+		r.Method(http.MethodGet, "/metrics", r.metrics.Handler())
+	}
+	routes := r.Mux
+	if r.prefix != "" {
+		routes = chi.NewRouter()
+		r.Mount(r.prefix, routes)
+	}
+	routes.With(r.LimitRedirect).Get("/{key}", r.Redirect)
+	routes.With(r.CheckSession, r.LimitCreate, r.ReadBody, r.GetShortLink, r.Compress).Post("/", r.SendPlainText)
+	routes.With(r.CheckSession, r.LimitCreate, r.ReadBody, r.UnmarshalData, r.GetShortLink, r.MarshalData, r.Compress).Post("/api/shorten", r.SendJSON)
+	routes.With(r.CheckSession, r.GetUrls, r.Compress).Get("/api/user/urls", r.SendJSON)
+	routes.With(r.CheckSession, r.GetStats, r.Compress).Get("/api/user/urls/{key}/stats", r.SendJSON)
+	routes.Get("/ping", r.Ping)
+	routes.With(r.CheckSession, r.ReadBody, r.LimitBatch, r.Batch, r.Compress).Post("/api/shorten/batch", r.SendJSON)
+	routes.With(r.CheckSession, r.ReadBody).Delete("/api/user/urls", r.DeleteUrls)
+	routes.With(r.CheckSession, r.ReadBody, r.RestoreUrls, r.Compress).Post("/api/user/urls/restore", r.SendJSON)
+	routes.With(r.CheckSession, r.GetDeletion, r.Compress).Get("/api/user/deletions/{id}", r.SendJSON)
 	return r
 }
 
+// maxTTL is the longest TTL of a link, longer ones would overflow a
+// time.Duration.
+const maxTTL = 100 * 365 * 24 * time.Hour
+
+// expiresAt resolves the expiration of a link given either as an absolute
+// time or as a TTL in seconds from now. It returns nil for a link that
+// never expires.
+func expiresAt(at *time.Time, ttl int64, now time.Time) (*time.Time, error) {
+	switch {
+	case at != nil && ttl != 0:
+		return nil, fmt.Errorf("%w: expires_at and ttl are mutually exclusive", ErrInvalidExpiry)
+	case ttl < 0:
+		return nil, fmt.Errorf("%w: ttl must be positive", ErrInvalidExpiry)
+	case ttl > int64(maxTTL/time.Second):
+		return nil, fmt.Errorf("%w: ttl must be at most %d", ErrInvalidExpiry, int64(maxTTL/time.Second))
+	case ttl > 0:
+		t := now.Add(time.Duration(ttl) * time.Second).UTC()
+		return &t, nil
+	case at != nil && !at.After(now):
+		return nil, fmt.Errorf("%w: expires_at is in the past", ErrInvalidExpiry)
+	case at != nil:
+		t := at.UTC()
+		return &t, nil
+	}
+	return nil, nil
+}
+
 func (r *Router) CheckSession(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-
-		uid := utils.RandString(6)
-		if cookie, err := req.Cookie("cutwell-session"); err != nil {
-			cookie = &http.Cookie{
-				Name:  "cutwell-session",
-				Value: uid,
-				Path:  "/",
+		uid, err := r.sessionUser(req)
+		if err != nil {
+			uid = utils.RandString(6)
+			token, err := r.decoder.Encode(uid)
+			if err != nil {
+				http.Error(w, "can't create session", http.StatusInternalServerError)
+				return
 			}
-			http.SetCookie(w, cookie)
-			req.AddCookie(cookie)
-		} else {
-			uid = cookie.Value
+			http.SetCookie(w, &http.Cookie{
+				Name:     SessionCookie,
+				Value:    token,
+				Path:     r.prefix + "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
 		}
 		ctx := context.WithValue(req.Context(), ContextKey("USERID"), uid)
 		next.ServeHTTP(w, req.WithContext(ctx))
 	})
 }
 
+// sessionUser returns the user id sealed in the session cookie. A missing,
+// tampered or otherwise undecodable cookie is reported as an error.
+func (r *Router) sessionUser(req *http.Request) (string, error) {
+	cookie, err := req.Cookie(SessionCookie)
+	if err != nil {
+		return "", err
+	}
+	uid, err := r.decoder.Decode(cookie.Value)
+	if err != nil {
+		return "", err
+	}
+	if len(uid) == 0 {
+		return "", errors.New("empty user id")
+	}
+	return uid, nil
+}
+
 func (r *Router) ReadBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		var reader io.Reader
@@ -106,6 +295,7 @@ func (r *Router) ReadBody(next http.Handler) http.Handler {
 			}
 			reader = gz
 			defer gz.Close()
+			r.metrics.gzipped("request")
 		} else {
 			reader = req.Body
 		}
@@ -163,6 +353,7 @@ func (r *Router) UnmarshalData(next http.Handler) http.Handler {
 			return
 		}
 		ctx := context.WithValue(req.Context(), ContextKey("DATA"), lnk.URL)
+		ctx = context.WithValue(ctx, ContextKey("LINK"), lnk)
 		next.ServeHTTP(w, req.WithContext(ctx))
 	})
 }
@@ -185,28 +376,34 @@ func (r *Router) GetShortLink(next http.Handler) http.Handler {
 			http.Error(w, "can't get context data", http.StatusBadRequest)
 			return
 		}
-		key, err := r.ls.Create(req.Context(), str, uid)
-
+		lnk, _ := req.Context().Value(ContextKey("LINK")).(Link)
+		var err error
+		lnk.URL, err = r.normalizer.Normalize(str)
 		if err != nil {
-			var pqerr *pq.Error
-			if errors.As(err, &pqerr) && pqerr.Code == pgerrcode.UniqueViolation {
-				key, err = r.ls.Find(req.Context(), str)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusBadRequest)
-					return
-				}
-				s = http.StatusConflict
-			} else {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err = r.checkPolicy(lnk.URL); err != nil {
+			httpError(w, rejectBlocked(str, "", err), errorStatus(err, http.StatusInternalServerError))
+			return
 		}
-		u := &url.URL{
-			Scheme: "http",
-			Host:   r.ls.Host(),
-			Path:   key,
+		lnk.ExpiresAt, err = expiresAt(lnk.ExpiresAt, lnk.TTL, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		ctx := context.WithValue(req.Context(), ContextKey("DATA"), u.String())
+		lnk.TTL = 0
+		key, err := r.ls.Create(req.Context(), lnk, uid)
+
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			key = conflict.Key
+			s = http.StatusConflict
+		} else if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+			return
+		}
+		ctx := context.WithValue(req.Context(), ContextKey("DATA"), r.ls.ShortURL(key))
 		ctx = context.WithValue(ctx, ContextKey("STATUS"), s)
 		next.ServeHTTP(w, req.WithContext(ctx))
 	})
@@ -230,6 +427,7 @@ func (r *Router) Compress(next http.Handler) http.Handler {
 		defer gz.Close()
 
 		w.Header().Set("Content-Encoding", "gzip")
+		r.metrics.gzipped("response")
 		next.ServeHTTP(gzipWriter{ResponseWriter: w, Writer: gz}, req)
 	})
 }
@@ -241,11 +439,21 @@ func (r *Router) GetUrls(next http.Handler) http.Handler {
 			http.Error(w, "can't get user id", http.StatusBadRequest)
 			return
 		}
-		lnks, err := r.ls.GetURLList(req.Context(), uid)
+		q, err := parseListQuery(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lnks, nextPage, err := r.ls.GetURLList(req.Context(), uid, q)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNoContent)
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		if len(lnks) == 0 {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
+		setNextPage(w, req, nextPage)
 		json, err := json.Marshal(&lnks)
 		if err != nil {
 			http.Error(w, "can't get context data", http.StatusNoContent)
@@ -257,6 +465,47 @@ func (r *Router) GetUrls(next http.Handler) http.Handler {
 	})
 }
 
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+// GetStats reports click analytics of the link in the {key} url parameter
+// for the last `days` days, 30 by default.
+func (r *Router) GetStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uid, ok := req.Context().Value(ContextKey("USERID")).(string)
+		if !ok || len(uid) == 0 {
+			http.Error(w, "can't get user id", http.StatusBadRequest)
+			return
+		}
+		days := defaultStatsDays
+		if v := req.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxStatsDays {
+				http.Error(w, fmt.Sprintf("days must be a number from 1 to %d", maxStatsDays), http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		since := today.AddDate(0, 0, 1-days)
+		stats, err := r.ls.Stats(req.Context(), chi.URLParam(req, "key"), uid, since)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		json, err := json.Marshal(stats)
+		if err != nil {
+			http.Error(w, "can't marshal data", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(req.Context(), ContextKey("DATA"), string(json))
+		ctx = context.WithValue(ctx, ContextKey("STATUS"), http.StatusOK)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
 func (r *Router) Batch(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		uid, ok := req.Context().Value(ContextKey("USERID")).(string)
@@ -280,9 +529,33 @@ func (r *Router) Batch(next http.Handler) http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		r.metrics.batch(len(batch))
+		now := time.Now()
+		for n := range batch {
+			raw := batch[n].URL
+			batch[n].URL, err = r.normalizer.Normalize(raw)
+			if err != nil {
+				var urlErr *URLError
+				if errors.As(err, &urlErr) {
+					urlErr.ID = batch[n].ID
+				}
+				httpError(w, err, http.StatusBadRequest)
+				return
+			}
+			if err = r.checkPolicy(batch[n].URL); err != nil {
+				httpError(w, rejectBlocked(raw, batch[n].ID, err), errorStatus(err, http.StatusInternalServerError))
+				return
+			}
+			batch[n].ExpiresAt, err = expiresAt(batch[n].ExpiresAt, batch[n].TTL, now)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			batch[n].TTL = 0
+		}
 		res, err := r.ls.Batch(req.Context(), batch, uid)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
 			return
 		}
 		json, err := json.Marshal(&res)
@@ -353,14 +626,18 @@ func (r *Router) SendJSON(w http.ResponseWriter, req *http.Request) {
 func (r *Router) Redirect(w http.ResponseWriter, req *http.Request) {
 	key := path.Base(req.URL.Path)
 	lnk, err := r.ls.Get(req.Context(), key)
-	if err == sql.ErrNoRows {
-		http.Error(w, err.Error(), http.StatusGone)
-		return
+	if err == nil {
+		// links shortened before their host was blocked stop resolving
+		err = r.checkPolicy(lnk)
 	}
+	r.metrics.redirect(err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
 		return
 	}
+	if r.clicks != nil {
+		r.clicks.Track(key, req)
+	}
 	w.Header().Set("Location", lnk)
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
@@ -396,10 +673,86 @@ func (r *Router) DeleteUrls(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = r.ls.Delete(req.Context(), urls, uid)
+	if r.deletes == nil {
+		if _, err = r.ls.Delete(req.Context(), urls, uid); err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	id, err := r.deletes.Enqueue(uid, urls)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
 		return
 	}
+	body, err := json.Marshal(DeletionJob{ID: id, Status: JobPending})
+	if err != nil {
+		http.Error(w, "can't marshal data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Location", r.prefix+"/api/user/deletions/"+id)
 	w.WriteHeader(http.StatusAccepted)
+	w.Write(body)
+}
+
+func (r *Router) RestoreUrls(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uid, ok := req.Context().Value(ContextKey("USERID")).(string)
+		if !ok || len(uid) == 0 {
+			http.Error(w, "can't get user id", http.StatusInternalServerError)
+			return
+		}
+		str, ok := req.Context().Value(ContextKey("DATA")).(string)
+		if !ok {
+			http.Error(w, "can't get context data", http.StatusInternalServerError)
+			return
+		}
+		var urls []string
+		if err := json.Unmarshal([]byte(str), &urls); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		outcomes, err := r.ls.Restore(req.Context(), urls, uid, time.Now().Add(-r.retention))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		json, err := json.Marshal(outcomes)
+		if err != nil {
+			http.Error(w, "can't marshal data", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(req.Context(), ContextKey("DATA"), string(json))
+		ctx = context.WithValue(ctx, ContextKey("STATUS"), http.StatusOK)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (r *Router) GetDeletion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uid, ok := req.Context().Value(ContextKey("USERID")).(string)
+		if !ok || len(uid) == 0 {
+			http.Error(w, "can't get user id", http.StatusBadRequest)
+			return
+		}
+		if r.deletes == nil {
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		job, err := r.deletes.Job(chi.URLParam(req, "id"), uid)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		json, err := json.Marshal(job)
+		if err != nil {
+			http.Error(w, "can't marshal data", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(req.Context(), ContextKey("DATA"), string(json))
+		ctx = context.WithValue(ctx, ContextKey("STATUS"), http.StatusOK)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
 }
@@ -2,11 +2,15 @@ package handler
 
 import (
 	"context"
+	"fmt"
+	"github.com/AlLevykin/cutwell/internal/utils"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type mockReader struct {
@@ -388,3 +392,118 @@ func TestRouter_MarshalData(t *testing.T) {
 		})
 	}
 }
+
+func TestRouter_CheckSession(t *testing.T) {
+	d := utils.NewDecoder("secret")
+	valid, err := d.Encode("000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := utils.NewDecoder("other").Encode("000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		cookie    string
+		want      string
+		newCookie bool
+	}{
+		{"no cookie", "", "", true},
+		{"valid cookie", valid, "000001", false},
+		{"plain user id", "000001", "", true},
+		{"foreign key", foreign, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var uid string
+			wantHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				uid, _ = req.Context().Value(ContextKey("USERID")).(string)
+			})
+			r := NewRouter(nil, d)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: SessionCookie, Value: tt.cookie})
+			}
+			r.CheckSession(wantHandler).ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+			if len(uid) == 0 {
+				t.Fatal("USERID not present")
+			}
+			if tt.want != "" && uid != tt.want {
+				t.Errorf("Expected user id %s, got %s", tt.want, uid)
+			}
+			cookies := res.Cookies()
+			if (len(cookies) != 0) != tt.newCookie {
+				t.Fatalf("Expected new cookie %v, got %v", tt.newCookie, cookies)
+			}
+			if tt.newCookie {
+				got, err := d.Decode(cookies[0].Value)
+				if err != nil || got != uid {
+					t.Errorf("Expected cookie for %s, got %s (%v)", uid, got, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_errorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", ErrNotFound, http.StatusNotFound},
+		{"conflict", &ConflictError{Key: "key"}, http.StatusConflict},
+		{"wrapped conflict", fmt.Errorf("%w: ya.ru", ErrConflict), http.StatusConflict},
+		{"gone", ErrGone, http.StatusGone},
+		{"invalid url", ErrInvalidURL, http.StatusBadRequest},
+		{"forbidden", ErrForbidden, http.StatusForbidden},
+		{"canceled", context.Canceled, http.StatusServiceUnavailable},
+		{"queue full", ErrQueueFull, http.StatusServiceUnavailable},
+		{"other", io.ErrUnexpectedEOF, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorStatus(tt.err, http.StatusInternalServerError); got != tt.want {
+				t.Errorf("errorStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_expiresAt(t *testing.T) {
+	now := time.Date(2022, 7, 30, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+	longest := now.Add(maxTTL)
+	tests := []struct {
+		name    string
+		at      *time.Time
+		ttl     int64
+		want    *time.Time
+		wantErr bool
+	}{
+		{"never", nil, 0, nil, false},
+		{"ttl", nil, 3600, &later, false},
+		{"absolute", &later, 0, &later, false},
+		{"past", &earlier, 0, nil, true},
+		{"negative ttl", nil, -1, nil, true},
+		{"longest ttl", nil, int64(maxTTL / time.Second), &longest, false},
+		{"overflowing ttl", nil, math.MaxInt64 / 1000, nil, true},
+		{"both", &later, 3600, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expiresAt(tt.at, tt.ttl, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expiresAt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && !got.Equal(*tt.want) {
+				t.Errorf("expiresAt() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
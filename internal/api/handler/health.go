@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCheckTimeout bounds every readiness check when none is configured.
+const DefaultCheckTimeout = 2 * time.Second
+
+// Check reports whether a dependency of the service works, nil when it does.
+type Check func(ctx context.Context) error
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Readiness is the breakdown returned by /readyz.
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health runs the checks of the readiness probe. The service is ready when
+// every check passes and it isn't draining.
+type Health struct {
+	checks   []namedCheck
+	timeout  time.Duration
+	draining int32
+}
+
+func NewHealth(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+	return &Health{timeout: timeout}
+}
+
+// Add registers the check name, it must be called before the router serves.
+func (h *Health) Add(name string, c Check) {
+	h.checks = append(h.checks, namedCheck{name: name, check: c})
+}
+
+// Drain makes the service not ready, so that load balancers stop sending
+// requests while the server shuts down.
+func (h *Health) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+func (h *Health) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// Ready runs the checks concurrently, each for the check timeout at most.
+func (h *Health) Ready(ctx context.Context) Readiness {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	res := Readiness{Status: "ready", Checks: make(map[string]CheckResult, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+			r := CheckResult{Status: "ok"}
+			if err := c.check(ctx); err != nil {
+				r = CheckResult{Status: "error", Error: err.Error()}
+			}
+			mu.Lock()
+			res.Checks[c.name] = r
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	for _, r := range res.Checks {
+		if r.Status != "ok" {
+			res.Status = "not ready"
+		}
+	}
+	if h.Draining() {
+		res.Status = "draining"
+	}
+	return res
+}
+
+// heartbeat is the last time a worker loop was alive, zero when the loop
+// isn't running.
+type heartbeat struct {
+	at int64
+}
+
+func (b *heartbeat) beat(now time.Time) {
+	atomic.StoreInt64(&b.at, now.UnixNano())
+}
+
+func (b *heartbeat) stop() {
+	atomic.StoreInt64(&b.at, 0)
+}
+
+// check fails when the loop isn't running or hasn't been alive for three
+// of its intervals.
+func (b *heartbeat) check(interval time.Duration, now time.Time) error {
+	at := atomic.LoadInt64(&b.at)
+	if at == 0 {
+		return errors.New("not running")
+	}
+	if since := now.Sub(time.Unix(0, at)); since > 3*interval {
+		return fmt.Errorf("stalled for %v", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (r *Router) Healthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Readyz reports the checks of the service, with status 503 when it can't
+// serve requests.
+func (r *Router) Readyz(w http.ResponseWriter, req *http.Request) {
+	res := r.health.Ready(req.Context())
+	body, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s := http.StatusOK
+	if res.Status != "ready" {
+		s = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(s)
+	w.Write(body)
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth_Ready(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("down") }
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	tests := []struct {
+		name   string
+		checks map[string]Check
+		drain  bool
+		want   string
+		failed string
+	}{
+		{"no checks", nil, false, "ready", ""},
+		{"ok", map[string]Check{"links": ok, "clicks": ok}, false, "ready", ""},
+		{"failing", map[string]Check{"links": ok, "clicks": failing}, false, "not ready", "clicks"},
+		{"timeout", map[string]Check{"links": slow}, false, "not ready", "links"},
+		{"draining", map[string]Check{"links": ok}, true, "draining", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth(50 * time.Millisecond)
+			for name, c := range tt.checks {
+				h.Add(name, c)
+			}
+			if tt.drain {
+				h.Drain()
+			}
+			got := h.Ready(context.Background())
+			if got.Status != tt.want || len(got.Checks) != len(tt.checks) {
+				t.Fatalf("Ready() got = %+v, want status %s", got, tt.want)
+			}
+			for name, r := range got.Checks {
+				if (r.Status != "ok") != (name == tt.failed) {
+					t.Errorf("Ready() check %s got %+v", name, r)
+				}
+			}
+		})
+	}
+}
+
+func Test_heartbeat_check(t *testing.T) {
+	now := time.Now()
+	var b heartbeat
+	if err := b.check(time.Second, now); err == nil {
+		t.Error("check() of a loop never started: want error")
+	}
+	b.beat(now.Add(-2 * time.Second))
+	if err := b.check(time.Second, now); err != nil {
+		t.Errorf("check() error = %v", err)
+	}
+	b.beat(now.Add(-4 * time.Second))
+	if err := b.check(time.Second, now); err == nil {
+		t.Error("check() of a stalled loop: want error")
+	}
+	b.stop()
+	if err := b.check(time.Second, now); err == nil {
+		t.Error("check() of a stopped loop: want error")
+	}
+}
+
+func TestRouter_Probes(t *testing.T) {
+	h := NewHealth(time.Second)
+	h.Add("links", func(ctx context.Context) error { return nil })
+	r := NewRouter(&limitLinks{}, utils.NewDecoder("secret"), WithHealth(h), WithPrefix("/s"))
+
+	for _, target := range []string{"/healthz", "/readyz"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s got status %d, want %d", target, w.Code, http.StatusOK)
+		}
+	}
+
+	h.Drain()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz while draining got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	var got Readiness
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("can't decode readiness: %v", err)
+	}
+	if got.Status != "draining" || got.Checks["links"].Status != "ok" {
+		t.Errorf("/readyz got = %+v", got)
+	}
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ListQuery selects a page of the links of a user. Links are ordered by
+// creation time, ties are broken by key.
+type ListQuery struct {
+	Limit int
+	// Cursor is the position after which the page starts, it is empty for
+	// the first page.
+	Cursor *Cursor
+	Desc   bool
+	// Filter keeps only the links whose original url contains it, case is
+	// ignored.
+	Filter string
+	// IncludeDeleted lists deleted and expired links too.
+	IncludeDeleted bool
+}
+
+// Cursor is the position of a link in a keyset ordered list.
+type Cursor struct {
+	CreatedAt time.Time
+	Key       string
+}
+
+func CursorOf(item Item) *Cursor {
+	c := &Cursor{Key: item.Key}
+	if item.CreatedAt != nil {
+		c.CreatedAt = *item.CreatedAt
+	}
+	return c
+}
+
+// Before reports whether a link created at t with key comes before c in
+// creation order.
+func (c *Cursor) Before(t time.Time, key string) bool {
+	if !t.Equal(c.CreatedAt) {
+		return t.Before(c.CreatedAt)
+	}
+	return key < c.Key
+}
+
+// String encodes the cursor as an opaque url safe token.
+func (c *Cursor) String() string {
+	var ns string
+	if !c.CreatedAt.IsZero() {
+		ns = strconv.FormatInt(c.CreatedAt.UnixNano(), 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(ns + ":" + c.Key))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	c := &Cursor{Key: parts[1]}
+	if parts[0] == "" {
+		return c, nil
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	c.CreatedAt = time.Unix(0, ns).UTC()
+	return c, nil
+}
+
+func parseListQuery(req *http.Request) (ListQuery, error) {
+	params := req.URL.Query()
+	q := ListQuery{
+		Limit:  DefaultListLimit,
+		Filter: params.Get("q"),
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxListLimit {
+			return q, fmt.Errorf("%w: limit must be a number from 1 to %d", ErrInvalidQuery, MaxListLimit)
+		}
+		q.Limit = n
+	}
+	if v := params.Get("cursor"); v != "" {
+		c, err := ParseCursor(v)
+		if err != nil {
+			return q, err
+		}
+		q.Cursor = c
+	}
+	if v := params.Get("include_deleted"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("%w: include_deleted must be a boolean", ErrInvalidQuery)
+		}
+		q.IncludeDeleted = b
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("%w: order must be asc or desc", ErrInvalidQuery)
+	}
+	return q, nil
+}
+
+// setNextPage advertises the page following the one that ends at next: the
+// X-Next-Cursor header holds the cursor parameter of that page and the
+// Link header its url. Both are exposed to cross-origin scripts. The last
+// page has neither.
+func setNextPage(w http.ResponseWriter, req *http.Request, next *Cursor) {
+	if next == nil {
+		return
+	}
+	token := next.String()
+	u := *req.URL
+	params := u.Query()
+	params.Set("cursor", token)
+	u.RawQuery = params.Encode()
+	w.Header().Set("X-Next-Cursor", token)
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", u.RequestURI()))
+	w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor, Link")
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursor_String(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{"ok", Cursor{CreatedAt: time.Date(2022, 7, 30, 12, 0, 0, 5, time.UTC), Key: "abc:def"}},
+		{"zero time", Cursor{Key: "abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCursor(tt.cursor.String())
+			if err != nil {
+				t.Fatalf("ParseCursor() error = %v", err)
+			}
+			if !got.CreatedAt.Equal(tt.cursor.CreatedAt) || got.Key != tt.cursor.Key {
+				t.Errorf("ParseCursor() got = %v, want %v", got, tt.cursor)
+			}
+		})
+	}
+}
+
+func Test_parseListQuery(t *testing.T) {
+	cursor := &Cursor{CreatedAt: time.Date(2022, 7, 30, 12, 0, 0, 0, time.UTC), Key: "abc"}
+	tests := []struct {
+		name    string
+		query   string
+		want    ListQuery
+		wantErr bool
+	}{
+		{"defaults", "", ListQuery{Limit: DefaultListLimit}, false},
+		{"all", "?limit=10&order=desc&q=ya.ru&cursor=" + cursor.String(),
+			ListQuery{Limit: 10, Cursor: cursor, Desc: true, Filter: "ya.ru"}, false},
+		{"asc", "?order=asc", ListQuery{Limit: DefaultListLimit}, false},
+		{"include deleted", "?include_deleted=true", ListQuery{Limit: DefaultListLimit, IncludeDeleted: true}, false},
+		{"bad include deleted", "?include_deleted=maybe", ListQuery{}, true},
+		{"zero limit", "?limit=0", ListQuery{}, true},
+		{"limit too big", "?limit=1001", ListQuery{}, true},
+		{"bad limit", "?limit=ten", ListQuery{}, true},
+		{"bad order", "?order=up", ListQuery{}, true},
+		{"bad cursor", "?cursor=!!!", ListQuery{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseListQuery(httptest.NewRequest("GET", "/api/user/urls"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseListQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("parseListQuery() error = %v, want %v", err, ErrInvalidQuery)
+				}
+				return
+			}
+			if got.Limit != tt.want.Limit || got.Desc != tt.want.Desc || got.Filter != tt.want.Filter ||
+				got.IncludeDeleted != tt.want.IncludeDeleted ||
+				(got.Cursor == nil) != (tt.want.Cursor == nil) ||
+				got.Cursor != nil && (!got.Cursor.CreatedAt.Equal(tt.want.Cursor.CreatedAt) || got.Cursor.Key != tt.want.Cursor.Key) {
+				t.Errorf("parseListQuery() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type pageLinks struct {
+	Links
+}
+
+func (l *pageLinks) GetURLList(ctx context.Context, user string, q ListQuery) ([]Item, *Cursor, error) {
+	if q.Cursor != nil {
+		return []Item{{Key: "b", ShortURL: "http://127.0.0.1:8080/b", URL: "http://go.dev"}}, nil, nil
+	}
+	return []Item{{Key: "a", ShortURL: "http://127.0.0.1:8080/a", URL: "http://ya.ru"}}, &Cursor{Key: "a"}, nil
+}
+
+func TestRouter_GetUrlsNextPage(t *testing.T) {
+	r := NewRouter(&pageLinks{}, utils.NewDecoder("secret"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls?limit=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first page got status %d, want %d", w.Code, http.StatusOK)
+	}
+	token := w.Header().Get("X-Next-Cursor")
+	if token != (&Cursor{Key: "a"}).String() {
+		t.Fatalf("first page got X-Next-Cursor %q", token)
+	}
+	wantLink := `</api/user/urls?cursor=` + token + `&limit=1>; rel="next"`
+	if got := w.Header().Get("Link"); got != wantLink {
+		t.Errorf("first page got Link %q, want %q", got, wantLink)
+	}
+	if got := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, "X-Next-Cursor") || !strings.Contains(got, "Link") {
+		t.Errorf("first page got Access-Control-Expose-Headers %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls?limit=1&cursor="+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("last page got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("X-Next-Cursor") != "" || w.Header().Get("Link") != "" {
+		t.Errorf("last page got next page headers %v", w.Header())
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metricsNamespace = "cutwell"
+
+// Outcomes of redirects.
+const (
+	RedirectHit      = "hit"
+	RedirectNotFound = "not_found"
+	RedirectGone     = "gone"
+	RedirectBlocked  = "blocked"
+	RedirectError    = "error"
+)
+
+// LinkHooks is notified by Links implementations of the links they store,
+// the stores call it when set in their config.
+type LinkHooks interface {
+	// LinksCreated is called with the number of new links stored.
+	LinksCreated(n int)
+}
+
+// Metrics are the Prometheus metrics of the service, in a registry of
+// their own with the Go runtime and process metrics. The methods of a nil
+// Metrics do nothing.
+type Metrics struct {
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	redirects *prometheus.CounterVec
+	created   prometheus.Counter
+	batches   prometheus.Histogram
+	gzip      *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route pattern and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "redirects_total",
+			Help:      "Redirects by outcome: hit, not_found, gone, blocked or error.",
+		}, []string{"outcome"}),
+		created: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "links_created_total",
+			Help:      "Links stored, one by one or in batches.",
+		}),
+		batches: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "batch_size",
+			Help:      "Links per batch request.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 7),
+		}),
+		gzip: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_gzip_total",
+			Help:      "Gzipped request bodies and responses.",
+		}, []string{"direction"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.latency, m.redirects, m.created, m.batches, m.gzip,
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveDeleteQueue exports the number of deletions waiting in dq.
+func (m *Metrics) ObserveDeleteQueue(dq *DeleteQueue) error {
+	return m.registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "delete_queue_depth",
+		Help:      "Deletions waiting in the delete queue.",
+	}, func() float64 {
+		return float64(len(dq.queue))
+	}))
+}
+
+func (m *Metrics) ObserveDB(name string, db *sql.DB) error {
+	return m.registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+func (m *Metrics) LinksCreated(n int) {
+	if m == nil {
+		return
+	}
+	m.created.Add(float64(n))
+}
+
+func (m *Metrics) redirect(err error) {
+	if m == nil {
+		return
+	}
+	outcome := RedirectHit
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotFound):
+		outcome = RedirectNotFound
+	case errors.Is(err, ErrGone):
+		outcome = RedirectGone
+	case errors.Is(err, ErrBlocked):
+		outcome = RedirectBlocked
+	default:
+		outcome = RedirectError
+	}
+	m.redirects.WithLabelValues(outcome).Inc()
+}
+
+func (m *Metrics) batch(n int) {
+	if m == nil {
+		return
+	}
+	m.batches.Observe(float64(n))
+}
+
+func (m *Metrics) gzipped(direction string) {
+	if m == nil {
+		return
+	}
+	m.gzip.WithLabelValues(direction).Inc()
+}
+
+// Instrument counts requests and measures their latency by route pattern,
+// requests matching no route are counted as "unmatched".
+func (r *Router) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.metrics == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+		next.ServeHTTP(ww, req)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(req.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			// the root of a mounted router is reported as "/prefix//"
+			route = strings.ReplaceAll(rctx.RoutePattern(), "//", "/")
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		r.metrics.requests.WithLabelValues(route, req.Method, strconv.Itoa(status)).Inc()
+		r.metrics.latency.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type metricsLinks struct {
+	limitLinks
+}
+
+func (l *metricsLinks) Get(ctx context.Context, key string) (string, error) {
+	switch key {
+	case "missing":
+		return "", ErrNotFound
+	case "deleted":
+		return "", ErrGone
+	}
+	return "http://ya.ru/" + key, nil
+}
+
+func gzipped(t *testing.T, s string) io.Reader {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestRouter_Metrics(t *testing.T) {
+	m := NewMetrics()
+	dq := NewDeleteQueue(&deleteLinks{}, DeleteQueueConfig{QueueSize: 10, BatchSize: 10})
+	if err := m.ObserveDeleteQueue(dq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dq.Enqueue("user", []string{"key"}); err != nil {
+		t.Fatal(err)
+	}
+	m.LinksCreated(2)
+	r := NewRouter(&metricsLinks{}, utils.NewDecoder("secret"), WithMetrics(m), WithPrefix("/s"))
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/s/", strings.NewReader("http://ya.ru")),
+		httptest.NewRequest(http.MethodGet, "/s/abc", nil),
+		httptest.NewRequest(http.MethodGet, "/s/def", nil),
+		httptest.NewRequest(http.MethodGet, "/s/missing", nil),
+		httptest.NewRequest(http.MethodGet, "/s/deleted", nil),
+		httptest.NewRequest(http.MethodGet, "/nowhere/at/all", nil),
+	}
+	batch := httptest.NewRequest(http.MethodPost, "/s/api/shorten/batch", gzipped(t,
+		`[{"correlation_id":"a","original_url":"http://ya.ru"},{"correlation_id":"b","original_url":"http://go.dev"}]`))
+	batch.Header.Set("Content-Encoding", "gzip")
+	batch.Header.Set("Accept-Encoding", "gzip")
+	requests = append(requests, batch)
+	for _, req := range requests {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics got status %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`cutwell_http_requests_total{code="201",method="POST",route="/s/"} 1`,
+		`cutwell_http_requests_total{code="307",method="GET",route="/s/{key}"} 2`,
+		`cutwell_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`cutwell_http_request_duration_seconds_count{method="GET",route="/s/{key}"} 4`,
+		`cutwell_redirects_total{outcome="hit"} 2`,
+		`cutwell_redirects_total{outcome="not_found"} 1`,
+		`cutwell_redirects_total{outcome="gone"} 1`,
+		`cutwell_links_created_total 2`,
+		`cutwell_batch_size_sum 2`,
+		`cutwell_http_gzip_total{direction="request"} 1`,
+		`cutwell_http_gzip_total{direction="response"} 1`,
+		`cutwell_delete_queue_depth 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics has no %s", want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultSchemes are the url schemes allowed when none are configured.
+var DefaultSchemes = []string{"http", "https"}
+
+// defaultPorts are stripped from normalized urls.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// URLError reports why a url was rejected. It is sent to clients as the
+// body of the error response.
+type URLError struct {
+	// ID is the correlation id of the rejected batch item.
+	ID     string `json:"correlation_id,omitempty"`
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+	// Err is the cause of a rejection other than an invalid url.
+	Err error `json:"-"`
+}
+
+func (e *URLError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%q: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("%v %q: %s", ErrInvalidURL, e.URL, e.Reason)
+}
+
+func (e *URLError) Is(target error) bool {
+	return e.Err == nil && target == ErrInvalidURL
+}
+
+func (e *URLError) Unwrap() error {
+	return e.Err
+}
+
+type NormalizerConfig struct {
+	// Schemes are the allowed url schemes, DefaultSchemes when empty.
+	Schemes []string
+	// SortQuery orders query parameters by name.
+	SortQuery bool
+}
+
+// Normalizer validates urls before they are shortened and brings them to a
+// normal form, so that the same url written differently is detected as a
+// duplicate.
+type Normalizer struct {
+	schemes   map[string]bool
+	sortQuery bool
+}
+
+func NewNormalizer(c NormalizerConfig) *Normalizer {
+	schemes := c.Schemes
+	if len(schemes) == 0 {
+		schemes = DefaultSchemes
+	}
+	n := &Normalizer{
+		schemes:   make(map[string]bool, len(schemes)),
+		sortQuery: c.SortQuery,
+	}
+	for _, s := range schemes {
+		n.schemes[strings.ToLower(s)] = true
+	}
+	return n
+}
+
+// Normalize returns the normal form of raw or a *URLError. The scheme and
+// host are lowercased, an internationalized host is converted to punycode
+// and the default port of the scheme is removed.
+func (n *Normalizer) Normalize(raw string) (string, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return "", &URLError{URL: raw, Reason: "url is empty"}
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", &URLError{URL: raw, Reason: "malformed url"}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme == "" {
+		return "", &URLError{URL: raw, Reason: "url has no scheme"}
+	}
+	if !n.schemes[u.Scheme] {
+		return "", &URLError{URL: raw, Reason: fmt.Sprintf("scheme %s is not allowed", u.Scheme)}
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", &URLError{URL: raw, Reason: "url has no host"}
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if ip := net.ParseIP(host); ip == nil {
+		host, err = idna.Lookup.ToASCII(host)
+		if err != nil || host == "" {
+			return "", &URLError{URL: raw, Reason: "invalid host"}
+		}
+	}
+	host = strings.ToLower(host)
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+
+	if n.sortQuery && u.RawQuery != "" {
+		// Encode orders the parameters by name
+		u.RawQuery = u.Query().Encode()
+	}
+	return u.String(), nil
+}
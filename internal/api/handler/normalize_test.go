@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizer_Normalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  NormalizerConfig
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"ok", NormalizerConfig{}, "https://ya.ru/maps?z=1&a=2", "https://ya.ru/maps?z=1&a=2", false},
+		{"spaces", NormalizerConfig{}, "  http://ya.ru/ \n", "http://ya.ru/", false},
+		{"case", NormalizerConfig{}, "HTTP://YA.RU/Maps", "http://ya.ru/Maps", false},
+		{"idn", NormalizerConfig{}, "http://пример.рф/путь", "http://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C", false},
+		{"default port", NormalizerConfig{}, "https://ya.ru:443/", "https://ya.ru/", false},
+		{"other port", NormalizerConfig{}, "http://ya.ru:8080/", "http://ya.ru:8080/", false},
+		{"ipv6 default port", NormalizerConfig{}, "http://[::1]:80/", "http://[::1]/", false},
+		{"sort query", NormalizerConfig{SortQuery: true}, "http://ya.ru/?z=1&a=2", "http://ya.ru/?a=2&z=1", false},
+		{"configured scheme", NormalizerConfig{Schemes: []string{"ftp"}}, "ftp://ya.ru:21/file", "ftp://ya.ru/file", false},
+		{"empty", NormalizerConfig{}, " ", "", true},
+		{"javascript", NormalizerConfig{}, "javascript:alert(1)", "", true},
+		{"not configured scheme", NormalizerConfig{Schemes: []string{"https"}}, "http://ya.ru", "", true},
+		{"no scheme", NormalizerConfig{}, "ya.ru", "", true},
+		{"no host", NormalizerConfig{}, "http:///path", "", true},
+		{"garbage", NormalizerConfig{}, "http://ya ru/%zz", "", true},
+		{"invalid host", NormalizerConfig{}, "http://ya..ru-/", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewNormalizer(tt.config).Normalize(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Normalize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidURL) {
+				t.Errorf("Normalize() error = %v, want %v", err, ErrInvalidURL)
+			}
+			if got != tt.want {
+				t.Errorf("Normalize() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouter_InvalidURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		wantID string
+	}{
+		{"plain text", "/", "javascript:alert(1)", ""},
+		{"json", "/api/shorten", `{"url":"javascript:alert(1)"}`, ""},
+		{"batch", "/api/shorten/batch", `[{"correlation_id":"a","original_url":"http://ya.ru"},` +
+			`{"correlation_id":"b","original_url":"javascript:alert(1)"}]`, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(nil, utils.NewDecoder("secret"))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+			}
+			var got struct {
+				Error  string `json:"error"`
+				ID     string `json:"correlation_id"`
+				URL    string `json:"url"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatalf("can't decode error: %v", err)
+			}
+			if got.URL != "javascript:alert(1)" || got.Reason == "" || got.ID != tt.wantID {
+				t.Errorf("got error %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"errors"
+	"net/url"
+)
+
+// Policy decides which hosts short links may point to.
+type Policy interface {
+	// Check returns an error wrapping ErrBlocked when links to host must
+	// be neither created nor followed.
+	Check(host string) error
+}
+
+// checkPolicy checks the host of lnk against the policy of the router.
+// Links the router can't parse are left to the caller.
+func (r *Router) checkPolicy(lnk string) error {
+	if r.policy == nil {
+		return nil
+	}
+	u, err := url.Parse(lnk)
+	if err != nil {
+		return nil
+	}
+	return r.policy.Check(u.Hostname())
+}
+
+// rejectBlocked wraps a policy error of lnk into a *URLError for the client.
+func rejectBlocked(lnk, id string, err error) error {
+	if !errors.Is(err, ErrBlocked) {
+		return err
+	}
+	return &URLError{ID: id, URL: lnk, Reason: err.Error(), Err: ErrBlocked}
+}
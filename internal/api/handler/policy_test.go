@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type hostPolicy map[string]bool
+
+func (p hostPolicy) Check(host string) error {
+	if p[host] {
+		return fmt.Errorf("%w: %s", ErrBlocked, host)
+	}
+	return nil
+}
+
+type policyLinks struct {
+	Links
+}
+
+func (l *policyLinks) Get(ctx context.Context, key string) (string, error) {
+	return "http://" + key + "/page", nil
+}
+
+func TestRouter_BlockedURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		wantID string
+	}{
+		{"plain text", "/", "http://EVIL.com/page", ""},
+		{"json", "/api/shorten", `{"url":"http://EVIL.com/page"}`, ""},
+		{"batch", "/api/shorten/batch", `[{"correlation_id":"a","original_url":"http://ya.ru"},` +
+			`{"correlation_id":"b","original_url":"http://EVIL.com/page"}]`, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(nil, utils.NewDecoder("secret"), WithPolicy(hostPolicy{"evil.com": true}))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusForbidden {
+				t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusForbidden)
+			}
+			var got struct {
+				Error  string `json:"error"`
+				ID     string `json:"correlation_id"`
+				URL    string `json:"url"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatalf("can't decode error: %v", err)
+			}
+			if got.Error != ErrBlocked.Error() || got.URL != "http://EVIL.com/page" || got.Reason == "" || got.ID != tt.wantID {
+				t.Errorf("got error %+v", got)
+			}
+		})
+	}
+}
+
+func TestRouter_RedirectBlocked(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"blocked", "evil.com", http.StatusForbidden},
+		{"allowed", "ya.ru", http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(&policyLinks{}, utils.NewDecoder("secret"), WithPolicy(hostPolicy{"evil.com": true}))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+tt.key, nil))
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is the rate of a token bucket: N tokens per Per. N is also the size
+// of the bucket, so up to N tokens can be taken at once.
+type Limit struct {
+	N   int
+	Per time.Duration
+}
+
+// ParseLimit parses a limit written as "N/duration", for example "60/1m".
+// An empty string or "0" is the zero Limit, which limits nothing.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid limit %q, want N/duration", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad count", s)
+	}
+	d, err := time.ParseDuration(parts[1])
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad duration", s)
+	}
+	return Limit{N: n, Per: d}, nil
+}
+
+func (l Limit) enabled() bool {
+	return l.N > 0 && l.Per > 0
+}
+
+func (l Limit) every() time.Duration {
+	return l.Per / time.Duration(l.N)
+}
+
+// Refill returns the tokens of a bucket that held tokens elapsed ago. A
+// negative elapsed, which clocks read out of order give, refills nothing.
+func (l Limit) Refill(tokens float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return tokens
+	}
+	return math.Min(float64(l.N), tokens+float64(elapsed)/float64(l.every()))
+}
+
+// Take takes n tokens from a refilled bucket holding tokens if it holds
+// enough of them. It returns the tokens left in the bucket.
+func (l Limit) Take(tokens float64, n int) (float64, Allowance) {
+	a := Allowance{Allowed: tokens >= float64(n)}
+	if a.Allowed {
+		tokens -= float64(n)
+	} else {
+		a.RetryAfter = time.Duration((float64(n) - tokens) * float64(l.every()))
+	}
+	a.Remaining = int(tokens)
+	a.Reset = time.Duration((float64(l.N) - tokens) * float64(l.every()))
+	return tokens, a
+}
+
+// TakeAll takes n tokens from every one of the refilled buckets holding
+// tokens, or from none of them if one doesn't hold enough, so that a denied
+// request uses up no quota. It leaves the tokens of the buckets in tokens
+// and returns the allowance of the most exhausted bucket.
+func (l Limit) TakeAll(tokens []float64, n int) Allowance {
+	var worst Allowance
+	left := make([]float64, len(tokens))
+	for i, t := range tokens {
+		var a Allowance
+		left[i], a = l.Take(t, n)
+		switch {
+		case i == 0:
+			worst = a
+		case worst.Allowed && !a.Allowed:
+			worst = a
+		case !worst.Allowed && !a.Allowed && a.RetryAfter > worst.RetryAfter:
+			worst = a
+		case worst.Allowed && a.Remaining < worst.Remaining:
+			worst = a
+		}
+	}
+	if worst.Allowed {
+		copy(tokens, left)
+	}
+	return worst
+}
+
+type Allowance struct {
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until a denied request can be allowed.
+	RetryAfter time.Duration
+}
+
+// LimitStore keeps the token buckets of a RateLimiter.
+type LimitStore interface {
+	// Take takes n tokens from each of the buckets keys of limit l, or
+	// from none of them if one of them doesn't allow it. Buckets seen for
+	// the first time are full.
+	Take(ctx context.Context, keys []string, l Limit, n int) (Allowance, error)
+	// Forget drops the buckets not used since before.
+	Forget(ctx context.Context, before time.Time) (int64, error)
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// MemoryLimitStore keeps token buckets in the process, so every instance
+// of the service limits clients on its own.
+type MemoryLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryLimitStore) Take(ctx context.Context, keys []string, l Limit, n int) (Allowance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the clock is read under the lock, so that the takes see it in order
+	now := s.now()
+	buckets := make([]*bucket, len(keys))
+	tokens := make([]float64, len(keys))
+	for i, key := range keys {
+		b, ok := s.buckets[key]
+		if !ok {
+			b = &bucket{tokens: float64(l.N), at: now}
+			s.buckets[key] = b
+		}
+		buckets[i] = b
+		tokens[i] = l.Refill(b.tokens, now.Sub(b.at))
+	}
+	a := l.TakeAll(tokens, n)
+	for i, b := range buckets {
+		b.tokens = tokens[i]
+		b.at = now
+	}
+	return a, nil
+}
+
+func (s *MemoryLimitStore) Forget(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, b := range s.buckets {
+		if b.at.Before(before) {
+			delete(s.buckets, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type RateLimitConfig struct {
+	Create   Limit
+	Batch    Limit
+	Redirect Limit
+	// Store keeps the buckets, a MemoryLimitStore when nil.
+	Store LimitStore
+	// TrustedProxies are the networks of the proxies in front of the
+	// service. The address of a request relayed by one of them is taken
+	// from X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+}
+
+// ParseProxies parses the addresses and CIDR networks of trusted proxies.
+func ParseProxies(s []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range s {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// RateLimiter limits the requests of users and client addresses with token
+// buckets. A zero limit turns limiting of its requests off.
+type RateLimiter struct {
+	cfg RateLimitConfig
+}
+
+func NewRateLimiter(c RateLimitConfig) *RateLimiter {
+	if c.Store == nil {
+		c.Store = NewMemoryLimitStore()
+	}
+	return &RateLimiter{cfg: c}
+}
+
+// Forget drops the buckets that have been full for a while. A bucket not
+// used for the longest period of the limits is full.
+func (rl *RateLimiter) Forget(ctx context.Context, now time.Time) (int64, error) {
+	var longest time.Duration
+	for _, l := range []Limit{rl.cfg.Create, rl.cfg.Batch, rl.cfg.Redirect} {
+		if l.Per > longest {
+			longest = l.Per
+		}
+	}
+	return rl.cfg.Store.Forget(ctx, now.Add(-longest))
+}
+
+// allow takes n tokens from the buckets of limit l under keys and sets the
+// RateLimit-* headers of the most exhausted bucket. A denied request is
+// answered with 429 and takes no tokens. Errors of the store let the
+// request through, an unavailable store should not make the service
+// unavailable too.
+func (rl *RateLimiter) allow(w http.ResponseWriter, req *http.Request, l Limit, n int, keys ...string) bool {
+	a, err := rl.cfg.Store.Take(req.Context(), keys, l, n)
+	if err != nil {
+		log.Printf("rate limit error: %v\n", err)
+		return true
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(l.N))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(a.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(a.Reset)))
+	if !a.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(a.RetryAfter)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (rl *RateLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range rl.cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of req. When the request
+// comes from a trusted proxy it is the last address of X-Forwarded-For
+// that isn't a trusted proxy too, the ones before it can be forged by the
+// client.
+func (rl *RateLimiter) clientIP(req *http.Request) string {
+	ip := clientIP(req.RemoteAddr)
+	if !rl.trusted(ip) {
+		return ip
+	}
+	var hops []string
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !rl.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// keys returns the buckets of the requests of the session user and of the
+// client address. Limiting by address catches clients that drop their
+// session cookie to get a new user id.
+func (rl *RateLimiter) keys(name string, req *http.Request) []string {
+	keys := []string{name + ":ip:" + rl.clientIP(req)}
+	if uid, ok := req.Context().Value(ContextKey("USERID")).(string); ok {
+		keys = append(keys, name+":user:"+uid)
+	}
+	return keys
+}
+
+// LimitCreate limits the links shortened one by one, it goes after
+// CheckSession.
+func (r *Router) LimitCreate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.limits == nil || !r.limits.cfg.Create.enabled() {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if r.limits.allow(w, req, r.limits.cfg.Create, 1, r.limits.keys("create", req)...) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// LimitBatch limits the urls shortened in batches, every url takes a token.
+// It goes after CheckSession and ReadBody.
+func (r *Router) LimitBatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.limits == nil || !r.limits.cfg.Batch.enabled() {
+			next.ServeHTTP(w, req)
+			return
+		}
+		l := r.limits.cfg.Batch
+		n := 1
+		var items []json.RawMessage
+		if data, ok := req.Context().Value(ContextKey("DATA")).(string); ok &&
+			json.Unmarshal([]byte(data), &items) == nil && len(items) > 0 {
+			n = len(items)
+		}
+		if n > l.N {
+			http.Error(w, fmt.Sprintf("batch of %d urls is over the limit of %d", n, l.N),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.limits.allow(w, req, l, n, r.limits.keys("batch", req)...) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+func (r *Router) LimitRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.limits == nil || !r.limits.cfg.Redirect.enabled() {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if r.limits.allow(w, req, r.limits.cfg.Redirect, 1, "redirect:ip:"+r.limits.clientIP(req)) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
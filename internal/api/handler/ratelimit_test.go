@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"context"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type limitLinks struct {
+	policyLinks
+}
+
+func (l *limitLinks) ShortURL(key string) string {
+	return "http://127.0.0.1:8080/" + key
+}
+
+func (l *limitLinks) Create(ctx context.Context, lnk Link, user string) (string, error) {
+	return "key", nil
+}
+
+func (l *limitLinks) Batch(ctx context.Context, batch []BatchItem, user string) ([]ResultItem, error) {
+	res := make([]ResultItem, len(batch))
+	for n, item := range batch {
+		res[n] = ResultItem{ID: item.ID, URL: "http://127.0.0.1:8080/key"}
+	}
+	return res, nil
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Limit
+		wantErr bool
+	}{
+		{"empty", "", Limit{}, false},
+		{"zero", "0", Limit{}, false},
+		{"ok", "60/1m", Limit{N: 60, Per: time.Minute}, false},
+		{"no duration", "60", Limit{}, true},
+		{"bad count", "many/1m", Limit{}, true},
+		{"bad duration", "60/minute", Limit{}, true},
+		{"zero duration", "60/0s", Limit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLimit(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLimit() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryLimitStore_Take(t *testing.T) {
+	now := time.Date(2022, 7, 30, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryLimitStore()
+	s.now = func() time.Time {
+		return now
+	}
+	l := Limit{N: 2, Per: 10 * time.Second}
+	ctx := context.Background()
+	steps := []struct {
+		name          string
+		after         time.Duration
+		n             int
+		want          bool
+		wantRemaining int
+		wantRetry     time.Duration
+	}{
+		{"full", 0, 1, true, 1, 0},
+		{"last", 0, 1, true, 0, 0},
+		{"empty", 0, 1, false, 0, 5 * time.Second},
+		{"too many", 5 * time.Second, 2, false, 1, 5 * time.Second},
+		{"refilled", 0, 1, true, 0, 0},
+		{"not over full", time.Hour, 2, true, 0, 0},
+	}
+	for _, st := range steps {
+		now = now.Add(st.after)
+		a, err := s.Take(ctx, []string{"key"}, l, st.n)
+		if err != nil {
+			t.Fatalf("%s: Take() error = %v", st.name, err)
+		}
+		if a.Allowed != st.want || a.Remaining != st.wantRemaining || a.RetryAfter != st.wantRetry {
+			t.Errorf("%s: Take() got = %+v", st.name, a)
+		}
+	}
+
+	if a, _ := s.Take(ctx, []string{"other"}, l, 1); !a.Allowed {
+		t.Error("Take() buckets are not separate")
+	}
+	n, err := s.Forget(ctx, now.Add(time.Second))
+	if err != nil || n != 2 || len(s.buckets) != 0 {
+		t.Errorf("Forget() got = %d, %v, left %d", n, err, len(s.buckets))
+	}
+
+	// a take denied by one bucket takes nothing from the others
+	s.Take(ctx, []string{"user"}, l, 2)
+	if a, _ := s.Take(ctx, []string{"ip", "user"}, l, 1); a.Allowed || a.Remaining != 0 {
+		t.Errorf("Take() of an empty bucket got = %+v", a)
+	}
+	if a, _ := s.Take(ctx, []string{"ip"}, l, 2); !a.Allowed {
+		t.Errorf("Take() of a bucket whose take was denied got = %+v", a)
+	}
+
+	// a clock read out of order refills nothing
+	now = now.Add(-time.Hour)
+	if a, _ := s.Take(ctx, []string{"ip"}, l, 1); a.Allowed {
+		t.Errorf("Take() back in time got = %+v", a)
+	}
+}
+
+func TestMemoryLimitStore_TakeConcurrent(t *testing.T) {
+	s := NewMemoryLimitStore()
+	l := Limit{N: 10, Per: time.Hour}
+	start := make(chan struct{})
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if a, _ := s.Take(context.Background(), []string{"key"}, l, 1); a.Allowed {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if allowed != int64(l.N) {
+		t.Errorf("Take() allowed %d of concurrent takes, want %d", allowed, l.N)
+	}
+}
+
+func TestLimit_TakeAll(t *testing.T) {
+	l := Limit{N: 4, Per: time.Minute}
+	tokens := []float64{3, 1}
+	if a := l.TakeAll(tokens, 1); !a.Allowed || a.Remaining != 0 || tokens[0] != 2 || tokens[1] != 0 {
+		t.Errorf("TakeAll() got = %+v, tokens %v", a, tokens)
+	}
+	if a := l.TakeAll(tokens, 1); a.Allowed || a.RetryAfter != 15*time.Second || tokens[0] != 2 {
+		t.Errorf("TakeAll() of an empty bucket got = %+v, tokens %v", a, tokens)
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       []string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"networks", []string{"10.0.0.0/8", " fd00::/8"}, []string{"10.0.0.0/8", "fd00::/8"}, false},
+		{"addresses", []string{"192.0.2.1", "::1"}, []string{"192.0.2.1/32", "::1/128"}, false},
+		{"bad address", []string{"proxy"}, nil, true},
+		{"bad network", []string{"10.0.0.0/33"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := ParseProxies(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseProxies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ParseProxies() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_clientIP(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimiter(RateLimitConfig{TrustedProxies: proxies})
+	tests := []struct {
+		name      string
+		addr      string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"forged hop", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:1234", []string{"198.51.100.7", "10.0.0.2"}, "198.51.100.7"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"garbage", "10.0.0.1:1234", []string{"unknown"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.addr
+			for _, h := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			if got := rl.clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouter_RateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     RateLimitConfig
+		method     string
+		target     string
+		body       string
+		cookie     bool
+		requests   int
+		wantStatus int
+	}{
+		{"create", RateLimitConfig{Create: Limit{N: 2, Per: time.Minute}},
+			http.MethodPost, "/", "http://ya.ru", true, 3, http.StatusTooManyRequests},
+		{"create by address", RateLimitConfig{Create: Limit{N: 2, Per: time.Minute}},
+			http.MethodPost, "/api/shorten", `{"url":"http://ya.ru"}`, false, 3, http.StatusTooManyRequests},
+		{"create within limit", RateLimitConfig{Create: Limit{N: 3, Per: time.Minute}},
+			http.MethodPost, "/", "http://ya.ru", true, 3, http.StatusCreated},
+		{"batch", RateLimitConfig{Batch: Limit{N: 3, Per: time.Minute}},
+			http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"a","original_url":"http://ya.ru"},` +
+				`{"correlation_id":"b","original_url":"http://ya.ru/maps"}]`, true, 2, http.StatusTooManyRequests},
+		{"batch too big", RateLimitConfig{Batch: Limit{N: 1, Per: time.Minute}},
+			http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"a","original_url":"http://ya.ru"},` +
+				`{"correlation_id":"b","original_url":"http://ya.ru/maps"}]`, true, 1, http.StatusRequestEntityTooLarge},
+		{"redirect", RateLimitConfig{Redirect: Limit{N: 1, Per: time.Minute}},
+			http.MethodGet, "/ya.ru", "", false, 2, http.StatusTooManyRequests},
+		{"redirect unlimited", RateLimitConfig{Create: Limit{N: 1, Per: time.Minute}},
+			http.MethodGet, "/ya.ru", "", false, 2, http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(&limitLinks{}, utils.NewDecoder("secret"), WithRateLimiter(NewRateLimiter(tt.config)))
+			token, _ := utils.NewDecoder("secret").Encode("user")
+			var w *httptest.ResponseRecorder
+			for i := 0; i < tt.requests; i++ {
+				req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+				if tt.cookie {
+					req.AddCookie(&http.Cookie{Name: SessionCookie, Value: token})
+				}
+				w = httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code == http.StatusTooManyRequests {
+				if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Limit") == "" ||
+					w.Header().Get("RateLimit-Remaining") == "" || w.Header().Get("RateLimit-Reset") == "" {
+					t.Errorf("got headers %v", w.Header())
+				}
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
@@ -12,17 +15,28 @@ type Config struct {
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 	ReadHeaderTimeout time.Duration
-	CancelTimeout     time.Duration
+	// CancelTimeout bounds how long Stop waits for the requests in flight.
+	CancelTimeout time.Duration
+	// TLS makes the server serve HTTPS, it serves plain HTTP when nil.
+	TLS *TLSConfig
 }
 
 type Server struct {
 	srv http.Server
-	ct  time.Duration
+	// redirect is the plain HTTP listener of a HTTPS server.
+	redirect *http.Server
+	// redirectDefault is set when redirect listens on the default address,
+	// the server starts without it when that can't be bound.
+	redirectDefault bool
+	ct              time.Duration
+	ln              net.Listener
+	errs            chan error
 }
 
-func NewServer(c Config, h http.Handler) *Server {
+func NewServer(c Config, h http.Handler) (*Server, error) {
 	s := &Server{}
 	s.ct = c.CancelTimeout
+	s.errs = make(chan error, 2)
 	s.srv = http.Server{
 		Addr:              c.Addr,
 		Handler:           h,
@@ -30,23 +44,109 @@ func NewServer(c Config, h http.Handler) *Server {
 		WriteTimeout:      c.WriteTimeout,
 		ReadHeaderTimeout: c.ReadHeaderTimeout,
 	}
-	return s
+	if c.TLS == nil {
+		return s, nil
+	}
+	cfg, err := c.TLS.config(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s.srv.TLSConfig = cfg
+	if addr := c.TLS.redirectAddr(c.Addr); addr != "" {
+		s.redirect = &http.Server{
+			Addr:              addr,
+			Handler:           redirectHandler(c.Addr),
+			ReadTimeout:       c.ReadTimeout,
+			WriteTimeout:      c.WriteTimeout,
+			ReadHeaderTimeout: c.ReadHeaderTimeout,
+		}
+		s.redirectDefault = c.TLS.RedirectAddr == ""
+	}
+	return s, nil
 }
 
-func (s *Server) Stop() {
-	ctx, cancel := context.WithTimeout(context.Background(), s.ct)
-	err := s.srv.Shutdown(ctx)
-	if err != nil {
-		log.Printf("server shutdown error: %v\n", err)
+// Scheme returns the url scheme the server is reached with.
+func (s *Server) Scheme() string {
+	if s.srv.TLSConfig != nil {
+		return "https"
 	}
-	cancel()
+	return "http"
 }
 
-func (s *Server) Start() {
-	go func() {
-		err := s.srv.ListenAndServe()
-		if err != nil {
-			log.Fatalf("server start error: %v\n", err)
+// Addr returns the address the server listens on once started, the
+// configured one before.
+func (s *Server) Addr() string {
+	if s.ln == nil {
+		return s.srv.Addr
+	}
+	return s.ln.Addr().String()
+}
+
+// Errors reports the errors that stop the server while it serves.
+func (s *Server) Errors() <-chan error {
+	return s.errs
+}
+
+// Start binds the listeners and serves in the background. Bind errors are
+// returned, the errors of serving are sent to Errors.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("server listen error: %w", err)
+	}
+	if s.redirect != nil {
+		rln, err := net.Listen("tcp", s.redirect.Addr)
+		switch {
+		case err != nil && s.redirectDefault:
+			// an unprivileged server can't bind port 80
+			log.Printf("redirect server not started: %v\n", err)
+			s.redirect = nil
+		case err != nil:
+			ln.Close()
+			return fmt.Errorf("redirect server listen error: %w", err)
+		default:
+			go s.serve("redirect server", func() error {
+				return s.redirect.Serve(rln)
+			})
+		}
+	}
+	s.ln = ln
+	go s.serve("server", func() error {
+		if s.srv.TLSConfig != nil {
+			// the certificate is in TLSConfig already
+			return s.srv.ServeTLS(ln, "", "")
 		}
-	}()
+		return s.srv.Serve(ln)
+	})
+	return nil
+}
+
+func (s *Server) serve(name string, serve func() error) {
+	if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.errs <- fmt.Errorf("%s error: %w", name, err)
+	}
+}
+
+// Stop stops accepting connections and waits for the requests in flight,
+// for CancelTimeout at most.
+func (s *Server) Stop(ctx context.Context) error {
+	if s.ct > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ct)
+		defer cancel()
+	}
+	var rerr error
+	if s.redirect != nil {
+		rerr = s.redirect.Shutdown(ctx)
+	}
+	err := s.srv.Shutdown(ctx)
+	switch {
+	case err != nil && rerr != nil:
+		return fmt.Errorf("server shutdown error: %w; redirect server shutdown error: %v", err, rerr)
+	case err != nil:
+		return fmt.Errorf("server shutdown error: %w", err)
+	case rerr != nil:
+		return fmt.Errorf("redirect server shutdown error: %w", rerr)
+	}
+	return nil
 }
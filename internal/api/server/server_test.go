@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_StartStop(t *testing.T) {
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv, err := NewServer(Config{Addr: "127.0.0.1:0"}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	busy, err := NewServer(Config{Addr: srv.Addr()}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = busy.Start(); err == nil {
+		t.Fatal("Start() on a busy address: want error")
+	}
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + srv.Addr())
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Stop(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err = <-stopped; err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+	if got := <-status; got != http.StatusNoContent {
+		t.Errorf("request in flight got status %d, want %d", got, http.StatusNoContent)
+	}
+	select {
+	case err = <-srv.Errors():
+		t.Errorf("Errors() got %v after a clean stop", err)
+	default:
+	}
+}
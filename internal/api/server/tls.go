@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cipher policies of TLS 1.2 connections, TLS 1.3 suites are not
+// configurable.
+const (
+	CiphersDefault = "default"
+	// CiphersModern allows only forward secret AEAD suites.
+	CiphersModern = "modern"
+)
+
+var modernCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// SelfSigned generates a certificate at startup when no files are
+	// given, for local development only.
+	SelfSigned bool
+	// MinVersion is the lowest version accepted, "1.2" when empty.
+	MinVersion string
+	// Ciphers is the cipher policy, CiphersDefault when empty.
+	Ciphers string
+	// RedirectAddr is the address of a plain HTTP listener redirecting to
+	// HTTPS, none when RedirectOff. When empty it is port 80 of the host of
+	// the server, and the server starts without it when the port can't be
+	// bound.
+	RedirectAddr string
+}
+
+// RedirectOff disables the HTTP listener of a HTTPS server.
+const RedirectOff = "off"
+
+// redirectAddr returns the address of the HTTP listener of a server on
+// addr, "" when there is none.
+func (c TLSConfig) redirectAddr(addr string) string {
+	switch strings.ToLower(c.RedirectAddr) {
+	case RedirectOff:
+		return ""
+	case "":
+		host, _, _ := net.SplitHostPort(addr)
+		return net.JoinHostPort(host, "80")
+	}
+	return c.RedirectAddr
+}
+
+func (c TLSConfig) config(addr string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if c.MinVersion == "" {
+		c.MinVersion = "1.2"
+	}
+	v, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls version %q, want 1.0 to 1.3", c.MinVersion)
+	}
+	cfg.MinVersion = v
+
+	switch strings.ToLower(c.Ciphers) {
+	case "", CiphersDefault:
+	case CiphersModern:
+		cfg.CipherSuites = modernCiphers
+	default:
+		return nil, fmt.Errorf("unknown cipher policy %q, want %s or %s", c.Ciphers, CiphersDefault, CiphersModern)
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case c.CertFile != "" || c.KeyFile != "":
+		cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	case c.SelfSigned:
+		cert, err = selfSigned(addr, time.Now())
+	default:
+		err = fmt.Errorf("tls needs a certificate and a key file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return cfg, nil
+}
+
+func selfSigned(addr string, now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"cutwell development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// redirectHandler redirects requests to the same url on the HTTPS listener
+// at addr.
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusPermanentRedirect)
+	})
+}
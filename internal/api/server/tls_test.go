@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig_config(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      TLSConfig
+		wantVersion uint16
+		wantCiphers int
+		wantErr     bool
+	}{
+		{"self-signed", TLSConfig{SelfSigned: true}, tls.VersionTLS12, 0, false},
+		{"modern", TLSConfig{SelfSigned: true, MinVersion: "1.3", Ciphers: "Modern"}, tls.VersionTLS13, len(modernCiphers), false},
+		{"no certificate", TLSConfig{}, 0, 0, true},
+		{"missing files", TLSConfig{CertFile: "missing.crt", KeyFile: "missing.key"}, 0, 0, true},
+		{"bad version", TLSConfig{SelfSigned: true, MinVersion: "2.0"}, 0, 0, true},
+		{"bad ciphers", TLSConfig{SelfSigned: true, Ciphers: "weak"}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.config("127.0.0.1:8443")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.MinVersion != tt.wantVersion || len(got.CipherSuites) != tt.wantCiphers || len(got.Certificates) != 1 {
+				t.Errorf("config() got = %+v", got)
+			}
+		})
+	}
+}
+
+func Test_selfSigned(t *testing.T) {
+	now := time.Now()
+	cert, err := selfSigned("shortener.local:8443", now)
+	if err != nil {
+		t.Fatalf("selfSigned() error = %v", err)
+	}
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("can't parse certificate: %v", err)
+	}
+	for _, host := range []string{"localhost", "shortener.local", "127.0.0.1"} {
+		if err := c.VerifyHostname(host); err != nil {
+			t.Errorf("VerifyHostname(%s) error = %v", host, err)
+		}
+	}
+	if !c.NotAfter.After(now) {
+		t.Errorf("certificate expires at %v", c.NotAfter)
+	}
+}
+
+func TestTLSConfig_redirectAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TLSConfig
+		addr   string
+		want   string
+	}{
+		{"default", TLSConfig{}, ":443", ":80"},
+		{"default of host", TLSConfig{}, "127.0.0.1:8443", "127.0.0.1:80"},
+		{"configured", TLSConfig{RedirectAddr: ":8080"}, ":443", ":8080"},
+		{"off", TLSConfig{RedirectAddr: "OFF"}, ":443", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.redirectAddr(tt.addr); got != tt.want {
+				t.Errorf("redirectAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewServer_redirect(t *testing.T) {
+	srv, err := NewServer(Config{Addr: "127.0.0.1:0", TLS: &TLSConfig{SelfSigned: true, RedirectAddr: "127.0.0.1:0"}}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.redirect == nil {
+		t.Fatal("NewServer() with TLS has no redirect listener")
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer srv.Stop(context.Background())
+
+	// a default listener that can't be bound doesn't stop the server
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	def, err := NewServer(Config{Addr: "127.0.0.1:0", TLS: &TLSConfig{SelfSigned: true}}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	def.redirect.Addr = busy.Addr().String()
+	if err = def.Start(); err != nil {
+		t.Fatalf("Start() with the default redirect address taken error = %v", err)
+	}
+	defer def.Stop(context.Background())
+	if def.redirect != nil {
+		t.Error("Start() kept a redirect listener it couldn't bind")
+	}
+
+	// a configured one must be bound
+	conf, err := NewServer(Config{Addr: "127.0.0.1:0", TLS: &TLSConfig{SelfSigned: true, RedirectAddr: busy.Addr().String()}}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Start(); err == nil {
+		conf.Stop(context.Background())
+		t.Error("Start() with the configured redirect address taken: want error")
+	}
+
+	off, err := NewServer(Config{Addr: "127.0.0.1:0", TLS: &TLSConfig{SelfSigned: true, RedirectAddr: RedirectOff}}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off.redirect != nil {
+		t.Error("NewServer() with the redirect off has a redirect listener")
+	}
+}
+
+func Test_redirectHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		host string
+		want string
+	}{
+		{"default port", ":443", "ya.ru", "https://ya.ru/key?q=1"},
+		{"other port", "127.0.0.1:8443", "localhost:8080", "https://localhost:8443/key?q=1"},
+		{"ipv6", ":443", "[::1]:8080", "https://[::1]/key?q=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/key?q=1", nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			redirectHandler(tt.addr).ServeHTTP(w, req)
+			if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+				t.Errorf("got %d %s, want %s", w.Code, w.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
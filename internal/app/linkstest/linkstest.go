@@ -0,0 +1,769 @@
+// Package linkstest provides a conformance test suite for handler.Links
+// implementations. Every link store runs it from its own tests:
+//
+//	linkstest.Run(t, func(t *testing.T, o linkstest.Options) handler.Links {
+//		return NewLinkStore(...)
+//	})
+package linkstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Options are the settings of a store made by a Factory.
+type Options struct {
+	// Dedup is the scope of duplicate links, handler.DedupGlobal when
+	// empty.
+	Dedup handler.DedupScope
+	// Keys generates the keys of links, random keys when nil.
+	Keys utils.KeyGenerator
+}
+
+// Factory returns a new empty store with the options o. It is called once
+// per subtest, so stores backed by a shared database must clean it up
+// before returning.
+type Factory func(t *testing.T, o Options) handler.Links
+
+const (
+	userA = "000001"
+	userB = "000002"
+)
+
+var firstPage = handler.ListQuery{Limit: handler.DefaultListLimit}
+
+// Run checks the whole handler.Links contract against the stores made by
+// newLinks, dedup scopes and key generators included.
+func Run(t *testing.T, newLinks Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ls handler.Links)
+	}{
+		{"create and get", testCreateGet},
+		{"invalid url", testInvalidURL},
+		{"conflict", testConflict},
+		{"find", testFind},
+		{"batch", testBatch},
+		{"batch conflict", testBatchConflict},
+		{"alias", testAlias},
+		{"batch alias", testBatchAlias},
+		{"expiry", testExpiry},
+		{"expired dedup", testExpiredDedup},
+		{"delete", testDelete},
+		{"delete batch", testDeleteBatch},
+		{"restore", testRestore},
+		{"deleted dedup", testDeletedDedup},
+		{"url list", testURLList},
+		{"url list pages", testURLListPages},
+		{"stats", testStats},
+		{"context done", testContextDone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newLinks(t, Options{}))
+		})
+	}
+	t.Run("dedup", func(t *testing.T) {
+		testDedup(t, newLinks)
+	})
+	t.Run("keys", func(t *testing.T) {
+		testKeys(t, newLinks)
+	})
+}
+
+// testDedup checks that the stores made by newLinks deduplicate links
+// according to their dedup scope.
+func testDedup(t *testing.T, newLinks Factory) {
+	tests := []struct {
+		scope handler.DedupScope
+		// same and other tell whether a link is deduplicated with the link
+		// of the same user and of another user
+		same  bool
+		other bool
+	}{
+		{handler.DedupGlobal, true, true},
+		{handler.DedupUser, true, false},
+		{handler.DedupNone, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.scope), func(t *testing.T) {
+			ls := newLinks(t, Options{Dedup: tt.scope})
+			key := create(t, ls, "http://ya.ru/Path", userA)
+			checkDedup(t, ls, "HTTP://YA.RU/Path", userA, key, tt.same)
+			checkDedup(t, ls, "http://ya.ru/Path", userB, key, tt.other)
+			checkDedup(t, ls, "http://ya.ru/path", userA, key, false)
+
+			got, err := ls.Find(context.Background(), "http://ya.ru/Path", userA)
+			if tt.same && (err != nil || got != key) {
+				t.Errorf("Find() = %v, %v, want %v", got, err, key)
+			}
+			if !tt.same {
+				wantErr(t, "Find", err, handler.ErrNotFound)
+			}
+		})
+	}
+}
+
+// checkDedup creates lnk of user and checks whether it is deduplicated
+// with the stored key.
+func checkDedup(t *testing.T, ls handler.Links, lnk string, user string, key string, dup bool) {
+	t.Helper()
+	got, err := ls.Create(context.Background(), handler.Link{URL: lnk}, user)
+	var conflict *handler.ConflictError
+	switch {
+	case dup && (!errors.As(err, &conflict) || conflict.Key != key):
+		t.Errorf("Create(%s) of %s = %v, %v, want conflict with %v", lnk, user, got, err, key)
+	case !dup && err != nil:
+		t.Errorf("Create(%s) of %s error = %v", lnk, user, err)
+	case !dup && got == key:
+		t.Errorf("Create(%s) of %s got stored key %v", lnk, user, key)
+	}
+}
+
+// scriptedKeys returns its keys in order whatever the attempt, and
+// utils.ErrKeyspaceFull when it runs out of them.
+type scriptedKeys struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *scriptedKeys) NewKey(in utils.KeyInput, attempt int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.keys) == 0 {
+		return "", utils.ErrKeyspaceFull
+	}
+	key := s.keys[0]
+	s.keys = s.keys[1:]
+	return key, nil
+}
+
+// testKeys checks that the stores made by newLinks retry the keys that
+// collide with stored ones, give up when the generator does and keep the
+// counter of sequential keys.
+func testKeys(t *testing.T, newLinks Factory) {
+	t.Run("collisions", func(t *testing.T) {
+		testKeyCollisions(t, newLinks)
+	})
+	t.Run("hash", func(t *testing.T) {
+		testHashKeys(t, newLinks)
+	})
+	t.Run("sequential", func(t *testing.T) {
+		testSequentialKeys(t, newLinks)
+	})
+}
+
+func testKeyCollisions(t *testing.T, newLinks Factory) {
+	ctx := context.Background()
+	keys := &scriptedKeys{keys: []string{"key001", "key001", "key002", "key002", "key001", "key003", "key004"}}
+	ls := newLinks(t, Options{Dedup: handler.DedupNone, Keys: keys})
+
+	if key := create(t, ls, "http://ya.ru/1", userA); key != "key001" {
+		t.Fatalf("Create() got key %v, want key001", key)
+	}
+	if key := create(t, ls, "http://ya.ru/2", userA); key != "key002" {
+		t.Errorf("Create() got key %v, want key002 after a collision", key)
+	}
+	res, err := ls.Batch(ctx, []handler.BatchItem{
+		{ID: "a", URL: "http://ya.ru/3"},
+		{ID: "b", URL: "http://ya.ru/4"},
+	}, userA)
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+	if len(res) != 2 || keyOf(t, res[0].URL) != "key003" || keyOf(t, res[1].URL) != "key004" {
+		t.Errorf("Batch() got %v, want keys key003 and key004 after collisions", res)
+	}
+	for n, key := range []string{"key001", "key002", "key003", "key004"} {
+		if got, err := ls.Get(ctx, key); err != nil || got != fmt.Sprintf("http://ya.ru/%d", n+1) {
+			t.Errorf("Get(%s) = %v, %v", key, got, err)
+		}
+	}
+
+	keys.keys = []string{"key001", "key002"}
+	_, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru/5"}, userA)
+	wantErr(t, "Create", err, utils.ErrKeyspaceFull)
+}
+
+func testHashKeys(t *testing.T, newLinks Factory) {
+	keys, err := utils.NewHashKeys(utils.RandomKeysConfig{Length: 9}, "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := newLinks(t, Options{Dedup: handler.DedupNone, Keys: keys})
+	key := create(t, ls, "http://ya.ru", userA)
+	_, err = ls.Create(context.Background(), handler.Link{URL: "http://ya.ru"}, userA)
+	var conflict *handler.ConflictError
+	if !errors.As(err, &conflict) || conflict.Key != key {
+		t.Errorf("Create() again error = %v, want conflict with %v", err, key)
+	}
+	if other := create(t, ls, "http://ya.ru", userB); other == key {
+		t.Errorf("Create() of another user got key %v", key)
+	}
+}
+
+func testSequentialKeys(t *testing.T, newLinks Factory) {
+	keys, err := utils.NewSequentialKeys(utils.Base62Alphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := newLinks(t, Options{Dedup: handler.DedupNone, Keys: keys})
+	prev := create(t, ls, "http://ya.ru/1", userA)
+	res, err := ls.Batch(context.Background(), []handler.BatchItem{
+		{ID: "a", URL: "http://ya.ru/2"},
+		{ID: "b", URL: "http://ya.ru/3"},
+	}, userA)
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+	for _, item := range res {
+		key := keyOf(t, item.URL)
+		if len(key) < len(prev) || len(key) == len(prev) && key <= prev {
+			t.Errorf("Batch() got key %v after %v", key, prev)
+		}
+		prev = key
+	}
+}
+
+func create(t *testing.T, ls handler.Links, lnk string, user string) string {
+	t.Helper()
+	key, err := ls.Create(context.Background(), handler.Link{URL: lnk}, user)
+	if err != nil {
+		t.Fatalf("Create(%s) error = %v", lnk, err)
+	}
+	if key == "" {
+		t.Fatalf("Create(%s) returned empty key", lnk)
+	}
+	return key
+}
+
+func keyOf(t *testing.T, shortURL string) string {
+	t.Helper()
+	u, err := url.Parse(shortURL)
+	if err != nil {
+		t.Fatalf("can't parse short url %s: %v", shortURL, err)
+	}
+	return path.Base(u.Path)
+}
+
+func wantErr(t *testing.T, method string, err error, target error) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Errorf("%s() error = %v, want %v", method, err, target)
+	}
+}
+
+func testCreateGet(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	key := create(t, ls, "http://ya.ru", userA)
+	got, err := ls.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got != "http://ya.ru" {
+		t.Errorf("Get() got = %v, want %v", got, "http://ya.ru")
+	}
+	_, err = ls.Get(ctx, "unknown")
+	wantErr(t, "Get", err, handler.ErrNotFound)
+}
+
+func testInvalidURL(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	_, err := ls.Create(ctx, handler.Link{}, userA)
+	wantErr(t, "Create", err, handler.ErrInvalidURL)
+	_, err = ls.Batch(ctx, []handler.BatchItem{{ID: "1", URL: ""}}, userA)
+	wantErr(t, "Batch", err, handler.ErrInvalidURL)
+}
+
+func testConflict(t *testing.T, ls handler.Links) {
+	key := create(t, ls, "http://ya.ru", userA)
+	_, err := ls.Create(context.Background(), handler.Link{URL: "http://ya.ru"}, userB)
+	wantErr(t, "Create", err, handler.ErrConflict)
+	var conflict *handler.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Create() error = %v, want *handler.ConflictError", err)
+	}
+	if conflict.Key != key {
+		t.Errorf("ConflictError.Key = %v, want %v", conflict.Key, key)
+	}
+}
+
+func testFind(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	key := create(t, ls, "http://ya.ru", userA)
+	got, err := ls.Find(ctx, "http://ya.ru", userA)
+	if err != nil {
+		t.Fatalf("Find() error = %v", err)
+	}
+	if got != key {
+		t.Errorf("Find() got = %v, want %v", got, key)
+	}
+	_, err = ls.Find(ctx, "http://google.com", userA)
+	wantErr(t, "Find", err, handler.ErrNotFound)
+}
+
+func testBatch(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	batch := []handler.BatchItem{
+		{ID: "a", URL: "http://ya.ru"},
+		{ID: "b", URL: "http://google.com"},
+	}
+	res, err := ls.Batch(ctx, batch, userA)
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+	if len(res) != len(batch) {
+		t.Fatalf("Batch() got %d items, want %d", len(res), len(batch))
+	}
+	for i, item := range res {
+		if item.ID != batch[i].ID {
+			t.Errorf("Batch() got correlation id %v, want %v", item.ID, batch[i].ID)
+		}
+		got, err := ls.Get(ctx, keyOf(t, item.URL))
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got != batch[i].URL {
+			t.Errorf("Get() got = %v, want %v", got, batch[i].URL)
+		}
+	}
+}
+
+func testBatchConflict(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	create(t, ls, "http://ya.ru", userA)
+	_, err := ls.Batch(ctx, []handler.BatchItem{
+		{ID: "a", URL: "http://google.com"},
+		{ID: "b", URL: "http://ya.ru"},
+	}, userB)
+	wantErr(t, "Batch", err, handler.ErrConflict)
+	_, err = ls.Find(ctx, "http://google.com", userB)
+	wantErr(t, "Find", err, handler.ErrNotFound)
+}
+
+func testAlias(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	key, err := ls.Create(ctx, handler.Link{URL: "http://ya.ru/spring", Alias: "spring-sale"}, userA)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if key != "spring-sale" {
+		t.Errorf("Create() got key %v, want %v", key, "spring-sale")
+	}
+	if got, err := ls.Get(ctx, "spring-sale"); err != nil || got != "http://ya.ru/spring" {
+		t.Errorf("Get() got = %v, %v", got, err)
+	}
+	_, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru/summer", Alias: "spring-sale"}, userB)
+	wantErr(t, "Create", err, handler.ErrAliasTaken)
+	_, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru/spring", Alias: "spring-sale"}, userA)
+	var conflict *handler.ConflictError
+	if !errors.As(err, &conflict) || conflict.Key != "spring-sale" {
+		t.Errorf("Create() of the same alias error = %v, want conflict on %v", err, "spring-sale")
+	}
+	for _, alias := range []string{"ab", "ping", "API", "spring sale", "весна"} {
+		_, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru/" + alias, Alias: alias}, userA)
+		wantErr(t, "Create", err, handler.ErrInvalidAlias)
+	}
+}
+
+func testBatchAlias(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	res, err := ls.Batch(ctx, []handler.BatchItem{
+		{ID: "a", URL: "http://ya.ru", Alias: "yandex"},
+		{ID: "b", URL: "http://google.com"},
+	}, userA)
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+	if keyOf(t, res[0].URL) != "yandex" {
+		t.Errorf("Batch() got short url %v, want alias %v", res[0].URL, "yandex")
+	}
+	_, err = ls.Batch(ctx, []handler.BatchItem{
+		{ID: "a", URL: "http://mail.ru", Alias: "yandex"},
+	}, userA)
+	wantErr(t, "Batch", err, handler.ErrAliasTaken)
+	_, err = ls.Batch(ctx, []handler.BatchItem{
+		{ID: "a", URL: "http://mail.ru", Alias: "ping"},
+	}, userA)
+	wantErr(t, "Batch", err, handler.ErrInvalidAlias)
+}
+
+func testExpiry(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	past := time.Now().Add(-time.Second)
+	live, err := ls.Create(ctx, handler.Link{URL: "http://ya.ru", ExpiresAt: &future}, userA)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	expired, err := ls.Create(ctx, handler.Link{URL: "http://google.com", ExpiresAt: &past}, userA)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := ls.Get(ctx, live); err != nil {
+		t.Errorf("Get() of live link error = %v", err)
+	}
+	_, err = ls.Get(ctx, expired)
+	wantErr(t, "Get", err, handler.ErrGone)
+	list, _, err := ls.GetURLList(ctx, userA, firstPage)
+	if err != nil {
+		t.Fatalf("GetURLList() error = %v", err)
+	}
+	if len(list) != 1 || keyOf(t, list[0].ShortURL) != live {
+		t.Fatalf("GetURLList() got = %v, want only %v", list, live)
+	}
+	if list[0].ExpiresAt == nil || !list[0].ExpiresAt.Equal(future) {
+		t.Errorf("GetURLList() got expires_at %v, want %v", list[0].ExpiresAt, future)
+	}
+}
+
+// testExpiredDedup checks that an expired link doesn't hold its url even
+// before it is swept by ExpireLinks.
+func testExpiredDedup(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Second)
+	expired, err := ls.Create(ctx, handler.Link{URL: "http://ya.ru", ExpiresAt: &past}, userA)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	_, err = ls.Find(ctx, "http://ya.ru", userA)
+	wantErr(t, "Find", err, handler.ErrNotFound)
+	again := create(t, ls, "http://ya.ru", userB)
+	if again == expired {
+		t.Fatalf("Create() after expiry got the expired key %v", expired)
+	}
+	if got, err := ls.Find(ctx, "http://ya.ru", userB); err != nil || got != again {
+		t.Errorf("Find() = %v, %v, want %v", got, err, again)
+	}
+	_, err = ls.Get(ctx, expired)
+	wantErr(t, "Get", err, handler.ErrGone)
+
+	if _, err := ls.Create(ctx, handler.Link{URL: "http://google.com", ExpiresAt: &past}, userA); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := ls.Batch(ctx, []handler.BatchItem{{ID: "a", URL: "http://google.com"}}, userA); err != nil {
+		t.Errorf("Batch() of an expired url error = %v", err)
+	}
+}
+
+func testDelete(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	deleted := create(t, ls, "http://ya.ru", userA)
+	foreign := create(t, ls, "http://google.com", userB)
+	kept := create(t, ls, "http://yandex.ru", userA)
+	outcomes, err := ls.Delete(ctx, []string{deleted, foreign, "unknown"}, userA)
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	wantOutcomes := map[string]handler.DeleteOutcome{
+		deleted:   handler.OutcomeDeleted,
+		foreign:   handler.OutcomeNotOwned,
+		"unknown": handler.OutcomeNotFound,
+	}
+	if !reflect.DeepEqual(outcomes, wantOutcomes) {
+		t.Errorf("Delete() got = %v, want %v", outcomes, wantOutcomes)
+	}
+	outcomes, err = ls.Delete(ctx, []string{deleted}, userA)
+	if err != nil || outcomes[deleted] != handler.OutcomeDeleted {
+		t.Errorf("Delete() of deleted link = %v, %v, want %v", outcomes, err, handler.OutcomeDeleted)
+	}
+	_, err = ls.Get(ctx, deleted)
+	wantErr(t, "Get", err, handler.ErrGone)
+	if _, err := ls.Get(ctx, foreign); err != nil {
+		t.Errorf("Get() of other user's link error = %v", err)
+	}
+	list, _, err := ls.GetURLList(ctx, userA, firstPage)
+	if err != nil {
+		t.Fatalf("GetURLList() error = %v", err)
+	}
+	if len(list) != 1 || keyOf(t, list[0].ShortURL) != kept || list[0].Deleted {
+		t.Errorf("GetURLList() got = %v, want only %v", list, kept)
+	}
+
+	list, _, err = ls.GetURLList(ctx, userA, handler.ListQuery{Limit: handler.DefaultListLimit, IncludeDeleted: true})
+	if err != nil {
+		t.Fatalf("GetURLList() error = %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("GetURLList() with deleted got = %v, want %v and %v", list, deleted, kept)
+	}
+	for _, item := range list {
+		switch keyOf(t, item.ShortURL) {
+		case deleted:
+			if !item.Deleted || item.DeletedAt == nil {
+				t.Errorf("GetURLList() got deleted link %+v without deletion time", item)
+			}
+		case kept:
+			if item.Deleted || item.DeletedAt != nil {
+				t.Errorf("GetURLList() got kept link %+v as deleted", item)
+			}
+		}
+	}
+}
+
+func testDeleteBatch(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	a := create(t, ls, "http://ya.ru", userA)
+	b := create(t, ls, "http://google.com", userB)
+	outcomes, err := ls.DeleteBatch(ctx, []handler.Deletion{
+		{User: userA, Keys: []string{a}},
+		{User: userB, Keys: []string{b, a}},
+		{User: userA, Keys: []string{"unknown"}},
+	})
+	if err != nil {
+		t.Fatalf("DeleteBatch() error = %v", err)
+	}
+	want := map[string]map[string]handler.DeleteOutcome{
+		userA: {a: handler.OutcomeDeleted, "unknown": handler.OutcomeNotFound},
+		userB: {b: handler.OutcomeDeleted, a: handler.OutcomeNotOwned},
+	}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("DeleteBatch() got = %v, want %v", outcomes, want)
+	}
+	for _, key := range []string{a, b} {
+		_, err = ls.Get(ctx, key)
+		wantErr(t, "Get", err, handler.ErrGone)
+	}
+}
+
+func testRestore(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	restored := create(t, ls, "http://ya.ru", userA)
+	late := create(t, ls, "http://yandex.ru", userA)
+	foreign := create(t, ls, "http://google.com", userB)
+	past := time.Now().Add(-time.Second)
+	expired, err := ls.Create(ctx, handler.Link{URL: "http://mail.ru", ExpiresAt: &past}, userA)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := ls.Delete(ctx, []string{restored, late, expired}, userA); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := ls.Delete(ctx, []string{foreign}, userB); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	hourAgo := time.Now().Add(-time.Hour)
+	outcomes, err := ls.Restore(ctx, []string{restored, foreign, expired, "unknown"}, userA, hourAgo)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	want := map[string]handler.DeleteOutcome{
+		restored:  handler.OutcomeRestored,
+		foreign:   handler.OutcomeNotOwned,
+		expired:   handler.OutcomeExpired,
+		"unknown": handler.OutcomeNotFound,
+	}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("Restore() got = %v, want %v", outcomes, want)
+	}
+	if got, err := ls.Get(ctx, restored); err != nil || got != "http://ya.ru" {
+		t.Errorf("Get() of restored link = %v, %v", got, err)
+	}
+	_, err = ls.Get(ctx, foreign)
+	wantErr(t, "Get", err, handler.ErrGone)
+
+	// a retention that ends in the future has passed for every deletion
+	outcomes, err = ls.Restore(ctx, []string{late}, userA, time.Now().Add(time.Hour))
+	if err != nil || outcomes[late] != handler.OutcomeNotFound {
+		t.Errorf("Restore() past retention = %v, %v, want %v", outcomes, err, handler.OutcomeNotFound)
+	}
+	_, err = ls.Get(ctx, late)
+	wantErr(t, "Get", err, handler.ErrGone)
+}
+
+// testDeletedDedup checks that a deleted link doesn't hold its url: the url
+// can be shortened again, after which the deleted link can't be restored.
+func testDeletedDedup(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	deleted := create(t, ls, "http://ya.ru", userA)
+	if _, err := ls.Delete(ctx, []string{deleted}, userA); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	_, err := ls.Find(ctx, "http://ya.ru", userA)
+	wantErr(t, "Find", err, handler.ErrNotFound)
+	again := create(t, ls, "http://ya.ru", userA)
+	if again == deleted {
+		t.Fatalf("Create() after deletion got the deleted key %v", deleted)
+	}
+	if got, err := ls.Find(ctx, "http://ya.ru", userA); err != nil || got != again {
+		t.Errorf("Find() = %v, %v, want %v", got, err, again)
+	}
+	_, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru"}, userA)
+	var conflict *handler.ConflictError
+	if !errors.As(err, &conflict) || conflict.Key != again {
+		t.Errorf("Create() of a shortened again url error = %v, want conflict on %v", err, again)
+	}
+
+	outcomes, err := ls.Restore(ctx, []string{deleted}, userA, time.Now().Add(-time.Hour))
+	if err != nil || outcomes[deleted] != handler.OutcomeConflict {
+		t.Errorf("Restore() of a shortened again url = %v, %v, want %v", outcomes, err, handler.OutcomeConflict)
+	}
+	_, err = ls.Get(ctx, deleted)
+	wantErr(t, "Get", err, handler.ErrGone)
+
+	if _, err := ls.Delete(ctx, []string{again}, userA); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := ls.Batch(ctx, []handler.BatchItem{{ID: "a", URL: "http://ya.ru"}}, userA); err != nil {
+		t.Errorf("Batch() of a deleted url error = %v", err)
+	}
+}
+
+func testURLList(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	want := []string{
+		create(t, ls, "http://ya.ru", userA),
+		create(t, ls, "http://yandex.ru", userA),
+	}
+	create(t, ls, "http://google.com", userB)
+	list, _, err := ls.GetURLList(ctx, userA, firstPage)
+	if err != nil {
+		t.Fatalf("GetURLList() error = %v", err)
+	}
+	got := make([]string, 0, len(list))
+	for _, item := range list {
+		got = append(got, keyOf(t, item.ShortURL))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("GetURLList() got keys %v, want %v", got, want)
+	}
+	list, next, err := ls.GetURLList(ctx, "unknown", firstPage)
+	if err != nil || len(list) != 0 || next != nil {
+		t.Errorf("GetURLList() of unknown user = %v, %v, %v, want empty page", list, next, err)
+	}
+}
+
+func testURLListPages(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	var all []string
+	for _, lnk := range []string{"http://ya.ru", "http://yandex.ru", "http://google.com", "http://mail.ru", "http://ya.ru/maps"} {
+		all = append(all, create(t, ls, lnk, userA))
+	}
+
+	tests := []struct {
+		name  string
+		query handler.ListQuery
+		want  []string
+	}{
+		{"ascending", handler.ListQuery{Limit: 2}, all},
+		{"descending", handler.ListQuery{Limit: 2, Desc: true}, reversed(all)},
+		{"filter", handler.ListQuery{Limit: 1, Filter: "YA.RU"}, []string{all[0], all[4]}},
+		{"filter escapes wildcards", handler.ListQuery{Limit: 10, Filter: "%"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			q := tt.query
+			for pages := 0; ; pages++ {
+				if pages > len(all) {
+					t.Fatalf("GetURLList() did not reach the last page")
+				}
+				list, next, err := ls.GetURLList(ctx, userA, q)
+				if err != nil {
+					t.Fatalf("GetURLList() error = %v", err)
+				}
+				if len(list) > q.Limit {
+					t.Fatalf("GetURLList() got %d items, limit %d", len(list), q.Limit)
+				}
+				for _, item := range list {
+					got = append(got, keyOf(t, item.ShortURL))
+				}
+				if next == nil {
+					break
+				}
+				q.Cursor = next
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("GetURLList() got keys %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func reversed(s []string) []string {
+	r := make([]string, 0, len(s))
+	for i := len(s) - 1; i >= 0; i-- {
+		r = append(r, s[i])
+	}
+	return r
+}
+
+func testStats(t *testing.T, ls handler.Links) {
+	ctx := context.Background()
+	key := create(t, ls, "http://ya.ru", userA)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.Add(-time.Hour)
+	lastMonth := today.AddDate(0, -1, 0)
+	err := ls.RecordClicks(ctx, []handler.Click{
+		{Key: key, At: today.Add(time.Hour), Referrer: "google.com", UserAgent: "curl/7.79.1", IPHash: "1"},
+		{Key: key, At: today.Add(2 * time.Hour), Referrer: "google.com", UserAgent: "Mozilla/5.0", IPHash: "2"},
+		{Key: key, At: yesterday, Referrer: "", UserAgent: "curl/7.79.1", IPHash: "1"},
+		{Key: key, At: lastMonth, Referrer: "mail.ru", UserAgent: "curl/7.79.1", IPHash: "3"},
+	})
+	if err != nil {
+		t.Fatalf("RecordClicks() error = %v", err)
+	}
+	stats, err := ls.Stats(ctx, key, userA, today.AddDate(0, 0, -6))
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.Total != 4 {
+		t.Errorf("Stats() got total %d, want 4", stats.Total)
+	}
+	wantDaily := []handler.DailyClicks{
+		{Date: yesterday.Format(handler.StatsDateLayout), Clicks: 1},
+		{Date: today.Format(handler.StatsDateLayout), Clicks: 2},
+	}
+	if len(stats.Daily) != len(wantDaily) || stats.Daily[0] != wantDaily[0] || stats.Daily[1] != wantDaily[1] {
+		t.Errorf("Stats() got daily %v, want %v", stats.Daily, wantDaily)
+	}
+	if len(stats.Referrers) != 3 || stats.Referrers[0] != (handler.ReferrerCount{Referrer: "google.com", Clicks: 2}) {
+		t.Errorf("Stats() got referrers %v, want google.com first", stats.Referrers)
+	}
+	wantUA := []handler.UserAgentCount{{UserAgent: "curl/7.79.1", Clicks: 3}, {UserAgent: "Mozilla/5.0", Clicks: 1}}
+	if len(stats.UserAgents) != len(wantUA) || stats.UserAgents[0] != wantUA[0] || stats.UserAgents[1] != wantUA[1] {
+		t.Errorf("Stats() got user agents %v, want %v", stats.UserAgents, wantUA)
+	}
+	if stats.Visitors != 3 {
+		t.Errorf("Stats() got %d visitors, want 3", stats.Visitors)
+	}
+
+	_, err = ls.Stats(ctx, key, userB, today)
+	wantErr(t, "Stats", err, handler.ErrForbidden)
+	_, err = ls.Stats(ctx, "unknown", userA, today)
+	wantErr(t, "Stats", err, handler.ErrNotFound)
+}
+
+func testContextDone(t *testing.T, ls handler.Links) {
+	key := create(t, ls, "http://ya.ru", userA)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ls.Create(ctx, handler.Link{URL: "http://google.com"}, userA)
+	wantErr(t, "Create", err, context.Canceled)
+	_, err = ls.Get(ctx, key)
+	wantErr(t, "Get", err, context.Canceled)
+	_, err = ls.Find(ctx, "http://ya.ru", userA)
+	wantErr(t, "Find", err, context.Canceled)
+	_, _, err = ls.GetURLList(ctx, userA, firstPage)
+	wantErr(t, "GetURLList", err, context.Canceled)
+	_, err = ls.Batch(ctx, []handler.BatchItem{{ID: "a", URL: "http://google.com"}}, userA)
+	wantErr(t, "Batch", err, context.Canceled)
+	_, err = ls.Delete(ctx, []string{key}, userA)
+	wantErr(t, "Delete", err, context.Canceled)
+	_, err = ls.Restore(ctx, []string{key}, userA, time.Now())
+	wantErr(t, "Restore", err, context.Canceled)
+}
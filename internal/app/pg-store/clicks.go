@@ -0,0 +1,124 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"log"
+	"time"
+)
+
+func (ls *LinkStore) RecordClicks(ctx context.Context, clicks []handler.Click) error {
+	if err := ls.unopened(); err != nil {
+		return err
+	}
+	tx, err := ls.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("clicks: unable to rollback: %v", err)
+		}
+	}()
+
+	stmt, err := tx.PrepareContext(ctx,
+		"INSERT INTO clicks(link, ts, referrer, user_agent, ip_hash) VALUES($1,$2,$3,$4,$5)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range clicks {
+		if _, err = stmt.ExecContext(ctx, c.Key, c.At, c.Referrer, c.UserAgent, c.IPHash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (ls *LinkStore) Stats(ctx context.Context, key string, user string, since time.Time) (*handler.Stats, error) {
+	if err := ls.unopened(); err != nil {
+		return nil, err
+	}
+	var owner string
+	err := ls.db.QueryRowContext(ctx, "SELECT usr FROM urls WHERE id=$1", key).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return nil, handler.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if owner != user {
+		return nil, handler.ErrForbidden
+	}
+
+	stats := &handler.Stats{
+		Daily:      make([]handler.DailyClicks, 0),
+		Referrers:  make([]handler.ReferrerCount, 0),
+		UserAgents: make([]handler.UserAgentCount, 0),
+	}
+	err = ls.db.QueryRowContext(ctx,
+		"SELECT count(*), count(DISTINCT nullif(ip_hash, '')) FROM clicks WHERE link=$1", key).
+		Scan(&stats.Total, &stats.Visitors)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := ls.db.QueryContext(ctx,
+		`SELECT to_char(ts AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*)
+		FROM clicks WHERE link=$1 AND ts >= $2 GROUP BY day ORDER BY day`, key, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d handler.DailyClicks
+		if err = rows.Scan(&d.Date, &d.Clicks); err != nil {
+			return nil, err
+		}
+		stats.Daily = append(stats.Daily, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refs, err := ls.db.QueryContext(ctx,
+		`SELECT referrer, count(*) AS n FROM clicks WHERE link=$1
+		GROUP BY referrer ORDER BY n DESC, referrer LIMIT $2`, key, handler.TopReferrers)
+	if err != nil {
+		return nil, err
+	}
+	defer refs.Close()
+	for refs.Next() {
+		var r handler.ReferrerCount
+		if err = refs.Scan(&r.Referrer, &r.Clicks); err != nil {
+			return nil, err
+		}
+		stats.Referrers = append(stats.Referrers, r)
+	}
+	if err = refs.Err(); err != nil {
+		return nil, err
+	}
+
+	uas, err := ls.db.QueryContext(ctx,
+		`SELECT user_agent, count(*) AS n FROM clicks WHERE link=$1
+		GROUP BY user_agent ORDER BY n DESC, user_agent LIMIT $2`, key, handler.TopReferrers)
+	if err != nil {
+		return nil, err
+	}
+	defer uas.Close()
+	for uas.Next() {
+		var u handler.UserAgentCount
+		if err = uas.Scan(&u.UserAgent, &u.Clicks); err != nil {
+			return nil, err
+		}
+		stats.UserAgents = append(stats.UserAgents, u)
+	}
+	if err = uas.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
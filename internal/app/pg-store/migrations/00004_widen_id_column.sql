@@ -0,0 +1,4 @@
+-- +goose Up
+ALTER TABLE urls ALTER COLUMN id TYPE varchar(64);
+-- +goose Down
+ALTER TABLE urls ALTER COLUMN id TYPE varchar(9);
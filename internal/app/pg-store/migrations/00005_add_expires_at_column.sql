@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE urls ADD COLUMN expires_at TIMESTAMPTZ;
+CREATE INDEX urls_expires_idx ON urls (expires_at) WHERE expires_at IS NOT NULL AND removed = false;
+DROP INDEX urls_links_idx;
+CREATE UNIQUE INDEX urls_links_idx ON urls ((lower(lnk))) WHERE NOT removed;
+-- +goose Down
+DROP INDEX urls_links_idx;
+CREATE UNIQUE INDEX urls_links_idx ON urls ((lower(lnk)));
+DROP INDEX urls_expires_idx;
+ALTER TABLE urls DROP COLUMN expires_at;
@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE clicks (
+                        id bigserial PRIMARY KEY,
+                        link varchar(64) NOT NULL,
+                        ts timestamptz NOT NULL,
+                        referrer text NOT NULL DEFAULT '',
+                        user_agent text NOT NULL DEFAULT '',
+                        ip_hash text NOT NULL DEFAULT ''
+);
+CREATE INDEX clicks_link_ts_idx ON clicks (link, ts);
+-- +goose Down
+DROP INDEX clicks_link_ts_idx;
+DROP TABLE clicks;
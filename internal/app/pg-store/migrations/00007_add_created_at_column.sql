@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE urls ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX urls_usr_created_idx ON urls (usr, created_at, id);
+-- +goose Down
+DROP INDEX urls_usr_created_idx;
+ALTER TABLE urls DROP COLUMN created_at;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE urls ADD COLUMN removed_at TIMESTAMPTZ;
+UPDATE urls SET removed_at = now() WHERE removed;
+CREATE INDEX urls_removed_at_idx ON urls (removed_at) WHERE removed;
+-- +goose Down
+DROP INDEX urls_removed_at_idx;
+ALTER TABLE urls DROP COLUMN removed_at;
@@ -0,0 +1,106 @@
+// Package migrations holds the Go migrations of the link store, the SQL
+// ones are embedded by the store itself.
+package migrations
+
+import (
+	"database/sql"
+	"github.com/pressly/goose/v3"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	goose.AddMigration(upAddDedupScope, downAddDedupScope)
+}
+
+// canonical is the canonical form of a url as of this migration: scheme
+// and host lowercased. It is a copy rather than handler.CanonicalURL so
+// that the migration keeps doing what it did when the app changes.
+func canonical(lnk string) string {
+	u, err := url.Parse(lnk)
+	if err != nil || u.Opaque != "" {
+		return lnk
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+func upAddDedupScope(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE urls ADD COLUMN canon text;
+		ALTER TABLE urls ADD COLUMN scope text NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+	canons, err := legacyCanons(tx)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("UPDATE urls SET canon = $2 WHERE id = $1")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, canon := range canons {
+		if _, err := stmt.Exec(id, canon); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`ALTER TABLE urls ALTER COLUMN canon SET NOT NULL;
+		DROP INDEX urls_links_idx;
+		CREATE UNIQUE INDEX urls_scope_canon_idx ON urls (scope, canon) WHERE NOT removed`)
+	return err
+}
+
+// legacyCanons returns the canons of the stored links by key. Links that
+// weren't duplicates before may share a canonical form, the unique index
+// can hold only one of them: the link already in canonical form keeps it
+// and the others keep their url as it is.
+func legacyCanons(tx *sql.Tx) (map[string]string, error) {
+	rows, err := tx.Query("SELECT id, lnk, coalesce(removed, false) FROM urls ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	canons := make(map[string]string)
+	held := make(map[string]bool)
+	var moved []string
+	links := make(map[string]string)
+	for rows.Next() {
+		var id, lnk string
+		var removed bool
+		if err := rows.Scan(&id, &lnk, &removed); err != nil {
+			return nil, err
+		}
+		canon := canonical(lnk)
+		canons[id] = canon
+		if removed {
+			continue
+		}
+		if canon == lnk {
+			held[canon] = true
+		} else {
+			moved = append(moved, id)
+			links[id] = lnk
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range moved {
+		if held[canons[id]] {
+			canons[id] = links[id]
+		}
+		held[canons[id]] = true
+	}
+	return canons, nil
+}
+
+func downAddDedupScope(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP INDEX urls_scope_canon_idx;
+		CREATE UNIQUE INDEX urls_links_idx ON urls ((lower(lnk))) WHERE NOT removed;
+		ALTER TABLE urls DROP COLUMN scope;
+		ALTER TABLE urls DROP COLUMN canon`)
+	return err
+}
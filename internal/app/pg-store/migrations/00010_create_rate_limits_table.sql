@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE rate_limits (
+                        key text PRIMARY KEY,
+                        tokens double precision NOT NULL,
+                        updated_at timestamptz NOT NULL
+);
+CREATE INDEX rate_limits_updated_at_idx ON rate_limits (updated_at);
+-- +goose Down
+DROP INDEX rate_limits_updated_at_idx;
+DROP TABLE rate_limits;
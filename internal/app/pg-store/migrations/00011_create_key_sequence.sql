@@ -0,0 +1,4 @@
+-- +goose Up
+CREATE SEQUENCE urls_key_seq AS bigint MINVALUE 1;
+-- +goose Down
+DROP SEQUENCE urls_key_seq;
@@ -0,0 +1,74 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"log"
+	"sort"
+	"time"
+)
+
+// Take implements handler.LimitStore, so that the instances of the service
+// sharing the database share their rate limits too. Buckets are timed by
+// the database clock, the clocks of the instances may differ.
+func (ls *LinkStore) Take(ctx context.Context, keys []string, l handler.Limit, n int) (handler.Allowance, error) {
+	if err := ls.unopened(); err != nil {
+		return handler.Allowance{}, err
+	}
+	tx, err := ls.db.BeginTx(ctx, nil)
+	if err != nil {
+		return handler.Allowance{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("rate limits: unable to rollback: %v", err)
+		}
+	}()
+
+	// the rows are locked until commit in the order of their keys, so that
+	// concurrent takes of the same buckets don't deadlock; elapsed is read
+	// by clock_timestamp() after the lock rather than by now(), the start
+	// of a transaction that may predate the last update of the row
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	tokens := make([]float64, len(sorted))
+	for i, key := range sorted {
+		var seconds float64
+		var inserted bool
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO rate_limits AS r (key, tokens, updated_at) VALUES ($1, 0, clock_timestamp())
+			ON CONFLICT (key) DO UPDATE SET key = r.key
+			RETURNING r.tokens, greatest(0, extract(epoch FROM clock_timestamp() - r.updated_at)), (xmax = 0)`,
+			key).Scan(&tokens[i], &seconds, &inserted)
+		if err != nil {
+			return handler.Allowance{}, err
+		}
+		if inserted {
+			tokens[i] = float64(l.N)
+			continue
+		}
+		tokens[i] = l.Refill(tokens[i], time.Duration(seconds*float64(time.Second)))
+	}
+	a := l.TakeAll(tokens, n)
+	for i, key := range sorted {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE rate_limits SET tokens=$2, updated_at=clock_timestamp() WHERE key=$1", key, tokens[i])
+		if err != nil {
+			return handler.Allowance{}, err
+		}
+	}
+	return a, tx.Commit()
+}
+
+// Forget implements handler.LimitStore.
+func (ls *LinkStore) Forget(ctx context.Context, before time.Time) (int64, error) {
+	if err := ls.unopened(); err != nil {
+		return 0, err
+	}
+	res, err := ls.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
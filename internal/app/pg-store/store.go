@@ -4,45 +4,126 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
 	"github.com/AlLevykin/cutwell/internal/api/handler"
+	_ "github.com/AlLevykin/cutwell/internal/app/pg-store/migrations"
 	"github.com/AlLevykin/cutwell/internal/app/store"
 	"github.com/AlLevykin/cutwell/internal/utils"
+	"github.com/jackc/pgerrcode"
 	"github.com/lib/pq"
 	"github.com/pressly/goose/v3"
 	"log"
-	"net/url"
-	"sync"
+	"strings"
+	"time"
 )
 
 //go:embed migrations/*.sql
 var embedMigrations embed.FS
 
+// urlsPkey is the primary key constraint of the urls table.
+const urlsPkey = "urls_pkey"
+
+// urlsScopeCanonIdx is the unique index of the urls held within a dedup
+// scope.
+const urlsScopeCanonIdx = "urls_scope_canon_idx"
+
 type LinkStore struct {
 	db        *sql.DB
 	KeyLength int
-	BaseURL   string
+	BaseURL   handler.BaseURL
+	Dedup     handler.DedupScope
+	Keys      utils.KeyGenerator
+	Hooks     handler.LinkHooks
+	// openErr is why the database couldn't be opened or migrated, or the
+	// key generator couldn't be made.
+	openErr error
 }
 
 func NewLinkStore(c store.Config, dsn string) *LinkStore {
 	goose.SetBaseFS(embedMigrations)
+	var openErr error
 	db, err := goose.OpenDBWithDriver("postgres", dsn)
 	if err != nil {
-		// log
-		fmt.Println(err)
-	}
-	if err := goose.Up(db, "migrations"); err != nil {
+		openErr = err
+	} else if err := goose.Up(db, "migrations"); err != nil {
 		db.Close()
 		db = nil
+		openErr = fmt.Errorf("migrations failed: %w", err)
+	}
+	keys, err := c.KeyGenerator()
+	if err != nil && openErr == nil {
+		openErr = fmt.Errorf("key generator: %w", err)
 	}
 	return &LinkStore{
 		db:        db,
 		KeyLength: c.KeyLength,
 		BaseURL:   c.BaseURL,
+		Dedup:     c.Dedup,
+		Keys:      keys,
+		Hooks:     c.Hooks,
+		openErr:   openErr,
+	}
+}
+
+// scopeColumn is the expression the scope column of a link holds for the
+// dedup scope of the store. Links are unique within their scope.
+func (ls *LinkStore) scopeColumn() string {
+	switch ls.Dedup {
+	case handler.DedupUser:
+		return "usr"
+	case handler.DedupNone:
+		return "id"
+	}
+	return "''"
+}
+
+// scope returns the scope of the link key of user.
+func (ls *LinkStore) scope(key, user string) string {
+	switch ls.Dedup {
+	case handler.DedupUser:
+		return user
+	case handler.DedupNone:
+		return key
+	}
+	return ""
+}
+
+// Rescope moves the stored links to the dedup scope of the store and
+// returns how many links were moved. It fails, changing nothing, when
+// links that are duplicates in the new scope are stored.
+func (ls *LinkStore) Rescope(ctx context.Context) (int64, error) {
+	if ls.db == nil {
+		return 0, pq.ErrNotSupported
+	}
+	scope := ls.scopeColumn()
+	res, err := ls.db.ExecContext(ctx,
+		fmt.Sprintf("UPDATE urls SET scope = %s WHERE scope <> %s", scope, scope))
+	if _, ok := uniqueViolation(err); ok {
+		return 0, fmt.Errorf("can't change dedup scope to %s, duplicate links are stored: %w", ls.Dedup, err)
+	}
+	if err != nil {
+		return 0, err
 	}
+	return res.RowsAffected()
+}
+
+// unopened returns why the database of the store couldn't be opened, nil
+// once it is open.
+func (ls *LinkStore) unopened() error {
+	if ls.db != nil {
+		return nil
+	}
+	if ls.openErr != nil {
+		return ls.openErr
+	}
+	return pq.ErrNotSupported
 }
 
 func (ls *LinkStore) Ping(ctx context.Context) error {
+	if ls.openErr != nil {
+		return ls.openErr
+	}
 	if ls.db == nil {
 		return pq.ErrNotSupported
 	}
@@ -52,51 +133,217 @@ func (ls *LinkStore) Ping(ctx context.Context) error {
 	return nil
 }
 
-func (ls *LinkStore) Host() string {
-	u, err := url.Parse(ls.BaseURL)
+// Migrated checks that the schema is at the version of the last embedded
+// migration.
+func (ls *LinkStore) Migrated(ctx context.Context) error {
+	if err := ls.Ping(ctx); err != nil {
+		return err
+	}
+	migrations, err := goose.CollectMigrations("migrations", 0, goose.MaxVersion)
 	if err != nil {
-		return ls.BaseURL
+		return err
 	}
-	return u.Host
+	last, err := migrations.Last()
+	if err != nil {
+		return err
+	}
+	version, err := goose.GetDBVersion(ls.db)
+	if err != nil {
+		return err
+	}
+	if version != last.Version {
+		return fmt.Errorf("schema version is %d, want %d", version, last.Version)
+	}
+	return nil
 }
 
-func (ls *LinkStore) Create(ctx context.Context, lnk string, user string) (string, error) {
-	key := utils.RandString(ls.KeyLength)
-	_, err := ls.db.ExecContext(ctx,
-		"INSERT INTO urls(id, lnk, usr) VALUES($1,$2,$3)",
-		key, lnk, user)
+func (ls *LinkStore) ShortURL(key string) string {
+	return ls.BaseURL.ShortURL(key)
+}
 
-	if err != nil {
-		return "", err
+// uniqueViolation returns the name of the violated constraint when err is a
+// postgres unique constraint violation.
+func uniqueViolation(err error) (string, bool) {
+	var pqerr *pq.Error
+	if errors.As(err, &pqerr) && pqerr.Code == pgerrcode.UniqueViolation {
+		return pqerr.Constraint, true
 	}
-	return key, nil
+	return "", false
+}
+
+// execer is a database or a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
-func (ls *LinkStore) Find(ctx context.Context, lnk string) (string, error) {
-	rows, err := ls.db.QueryContext(ctx, "SELECT id from urls where lnk=$1", lnk)
+// releaseExpired marks the expired links holding canons in scope as
+// removed, as ExpireLinks does, so that the unique index lets the urls be
+// shortened again before the links are swept.
+func releaseExpired(ctx context.Context, q execer, scope string, canons []string) (int64, error) {
+	res, err := q.ExecContext(ctx,
+		`UPDATE urls SET removed = true, removed_at = now()
+		WHERE scope = $1 AND canon = ANY($2) AND NOT removed AND expires_at <= now()`,
+		scope, pq.Array(canons))
 	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// insertLink inserts a link unless its key is taken, in which case no
+// rows are returned; a collision neither raises an error nor aborts the
+// transaction of a batch.
+const insertLink = `INSERT INTO urls(id, lnk, canon, scope, usr, expires_at) VALUES($1,$2,$3,$4,$5,$6)
+	ON CONFLICT ON CONSTRAINT urls_pkey DO NOTHING RETURNING id`
+
+// queryer is a database or a transaction.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// keyInput returns what the key of lnk of user is made from, the counter
+// of sequential keys is the urls_key_seq sequence.
+func keyInput(ctx context.Context, q queryer, lnk string, user string) utils.KeyInput {
+	return utils.KeyInput{
+		URL:  lnk,
+		User: user,
+		Next: func() (uint64, error) {
+			var n uint64
+			err := q.QueryRowContext(ctx, "SELECT nextval('urls_key_seq')").Scan(&n)
+			return n, err
+		},
+	}
+}
+
+// newKey returns the requested alias, once it is validated, or a new key
+// for the attempt-th try to insert a link.
+func (ls *LinkStore) newKey(alias string, in utils.KeyInput, attempt int) (string, error) {
+	if alias == "" {
+		if ls.Keys == nil {
+			return "", errors.New("no key generator")
+		}
+		for {
+			key, err := ls.Keys.NewKey(in, attempt)
+			if err != nil || !handler.ReservedKey(key) {
+				return key, err
+			}
+			attempt++
+		}
+	}
+	if err := handler.ValidateAlias(alias); err != nil {
 		return "", err
 	}
-	defer rows.Close()
+	return alias, nil
+}
 
-	if rows.Next() {
-		var link string
-		err = rows.Scan(&link)
+// holds reports whether the generated key taken by another insert holds lnk
+// of user already, as a hash key of a link created again does.
+func holds(ctx context.Context, q queryer, key string, lnk string, user string) (bool, error) {
+	var same bool
+	err := q.QueryRowContext(ctx,
+		"SELECT canon=$2 AND usr=$3 AND NOT removed AND coalesce(expires_at > now(), true) FROM urls WHERE id=$1",
+		key, handler.CanonicalURL(lnk), user).Scan(&same)
+	return same, err
+}
+
+func (ls *LinkStore) Create(ctx context.Context, lnk handler.Link, user string) (string, error) {
+	if err := ls.unopened(); err != nil {
+		return "", err
+	}
+	if lnk.URL == "" {
+		return "", handler.ErrInvalidURL
+	}
+	in := keyInput(ctx, ls.db, lnk.URL, user)
+	for attempt := 0; ; attempt++ {
+		key, err := ls.newKey(lnk.Alias, in, attempt)
 		if err != nil {
 			return "", err
 		}
-		return link, nil
+		err = ls.db.QueryRowContext(ctx, insertLink,
+			key, lnk.URL, handler.CanonicalURL(lnk.URL), ls.scope(key, user), user, lnk.ExpiresAt).Scan(&key)
+		if errors.Is(err, sql.ErrNoRows) {
+			if lnk.Alias != "" {
+				return "", ls.conflict(ctx, urlsPkey, lnk, user, err)
+			}
+			same, err := holds(ctx, ls.db, key, lnk.URL, user)
+			if err != nil {
+				return "", err
+			}
+			if same {
+				return "", &handler.ConflictError{Key: key}
+			}
+			continue
+		}
+		if constraint, ok := uniqueViolation(err); ok {
+			if constraint == urlsScopeCanonIdx {
+				released, err := releaseExpired(ctx, ls.db, ls.scope(key, user), []string{handler.CanonicalURL(lnk.URL)})
+				if err != nil {
+					return "", err
+				}
+				if released > 0 {
+					continue
+				}
+			}
+			return "", ls.conflict(ctx, constraint, lnk, user, err)
+		}
+		if err != nil {
+			return "", err
+		}
+		ls.created(1)
+		return key, nil
 	}
+}
 
-	if err = rows.Err(); err != nil {
-		return "", err
+// created reports n new links to the hooks.
+func (ls *LinkStore) created(n int) {
+	if ls.Hooks != nil {
+		ls.Hooks.LinksCreated(n)
 	}
+}
 
-	return "", sql.ErrNoRows
+// DB returns the connection pool of the store, nil when it couldn't be
+// opened.
+func (ls *LinkStore) DB() *sql.DB {
+	return ls.db
 }
 
-func (ls *LinkStore) Get(ctx context.Context, key string) (string, error) {
-	rows, err := ls.db.QueryContext(ctx, "SELECT lnk FROM urls WHERE id=$1 AND removed = false", key)
+// conflict explains the unique violation err raised by inserting lnk.
+func (ls *LinkStore) conflict(ctx context.Context, constraint string, lnk handler.Link, user string, err error) error {
+	if constraint == urlsPkey {
+		if lnk.Alias == "" {
+			return err
+		}
+		var canon, scope string
+		var held bool
+		err = ls.db.QueryRowContext(ctx,
+			"SELECT canon, scope, NOT removed AND coalesce(expires_at > now(), true) FROM urls WHERE id=$1",
+			lnk.Alias).Scan(&canon, &scope, &held)
+		if err != nil {
+			return err
+		}
+		if ls.Dedup != handler.DedupNone && held && canon == handler.CanonicalURL(lnk.URL) &&
+			scope == ls.scope(lnk.Alias, user) {
+			return &handler.ConflictError{Key: lnk.Alias}
+		}
+		return fmt.Errorf("%w: %s", handler.ErrAliasTaken, lnk.Alias)
+	}
+	key, err := ls.Find(ctx, lnk.URL, user)
+	if err != nil {
+		return err
+	}
+	return &handler.ConflictError{Key: key}
+}
+
+func (ls *LinkStore) Find(ctx context.Context, lnk string, user string) (string, error) {
+	if err := ls.unopened(); err != nil {
+		return "", err
+	}
+	if ls.Dedup == handler.DedupNone {
+		return "", handler.ErrNotFound
+	}
+	rows, err := ls.db.QueryContext(ctx,
+		`SELECT id FROM urls WHERE scope=$1 AND canon=$2 AND NOT removed
+		AND (expires_at IS NULL OR expires_at > now())`, ls.scope("", user), handler.CanonicalURL(lnk))
 	if err != nil {
 		return "", err
 	}
@@ -115,63 +362,134 @@ func (ls *LinkStore) Get(ctx context.Context, key string) (string, error) {
 		return "", err
 	}
 
-	return "", sql.ErrNoRows
+	return "", handler.ErrNotFound
 }
 
-func (ls *LinkStore) GetURLList(ctx context.Context, u string) ([]handler.Item, error) {
+func (ls *LinkStore) Get(ctx context.Context, key string) (string, error) {
+	if err := ls.unopened(); err != nil {
+		return "", err
+	}
+	var link string
+	var removed, expired bool
+	err := ls.db.QueryRowContext(ctx,
+		"SELECT lnk, removed, coalesce(expires_at <= now(), false) FROM urls WHERE id=$1", key).
+		Scan(&link, &removed, &expired)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return "", handler.ErrNotFound
+	case err != nil:
+		return "", err
+	case removed:
+		return "", handler.ErrGone
+	case expired:
+		return "", fmt.Errorf("%w: expired", handler.ErrGone)
+	}
+	return link, nil
+}
+
+// likePattern escapes s for use as a substring pattern of ILIKE.
+func likePattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(s) + "%"
+}
+
+func (ls *LinkStore) GetURLList(ctx context.Context, u string, q handler.ListQuery) ([]handler.Item, *handler.Cursor, error) {
+	if err := ls.unopened(); err != nil {
+		return nil, nil, err
+	}
+	var query strings.Builder
+	args := []interface{}{u}
+	query.WriteString(`SELECT id, lnk, created_at, expires_at,
+			removed OR coalesce(expires_at <= now(), false),
+			CASE WHEN removed THEN removed_at WHEN expires_at <= now() THEN expires_at END
+		FROM urls WHERE usr=$1`)
+	if !q.IncludeDeleted {
+		query.WriteString(" AND removed = false AND (expires_at IS NULL OR expires_at > now())")
+	}
+	if q.Filter != "" {
+		args = append(args, likePattern(q.Filter))
+		fmt.Fprintf(&query, " AND lnk ILIKE $%d", len(args))
+	}
+	order, cmp := "ASC", ">"
+	if q.Desc {
+		order, cmp = "DESC", "<"
+	}
+	if q.Cursor != nil {
+		args = append(args, q.Cursor.CreatedAt, q.Cursor.Key)
+		fmt.Fprintf(&query, " AND (created_at, id) %s ($%d, $%d)", cmp, len(args)-1, len(args))
+	}
+	args = append(args, q.Limit+1)
+	fmt.Fprintf(&query, " ORDER BY created_at %s, id %s LIMIT $%d", order, order, len(args))
+
 	result := make([]handler.Item, 0)
 
-	rows, err := ls.db.QueryContext(ctx, "SELECT id, lnk from urls where usr=$1", u)
+	rows, err := ls.db.QueryContext(ctx, query.String(), args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var key string
 		var link string
-		err = rows.Scan(&key, &link)
+		var created time.Time
+		var expires sql.NullTime
+		var deleted bool
+		var deletedAt sql.NullTime
+		err = rows.Scan(&key, &link, &created, &expires, &deleted, &deletedAt)
 		if err != nil {
-			return nil, err
-		}
-
-		shortURL := &url.URL{
-			Scheme: "http",
-			Host:   ls.Host(),
-			Path:   key,
+			return nil, nil, err
 		}
 
 		result = append(result,
 			handler.Item{
-				ShortURL: shortURL.String(),
-				URL:      link,
+				Key:       key,
+				ShortURL:  ls.ShortURL(key),
+				URL:       link,
+				CreatedAt: &created,
+				ExpiresAt: nullTime(expires),
+				Deleted:   deleted,
+				DeletedAt: nullTime(deletedAt),
 			},
 		)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if len(result) == 0 {
-		return nil, sql.ErrNoRows
+	if len(result) > q.Limit {
+		result = result[:q.Limit]
+		return result, handler.CursorOf(result[q.Limit-1]), nil
 	}
-
-	return result, nil
+	return result, nil, nil
 }
 
 func (ls *LinkStore) Batch(ctx context.Context, batch []handler.BatchItem, user string) ([]handler.ResultItem, error) {
-	tx, err := ls.db.Begin()
+	if err := ls.unopened(); err != nil {
+		return nil, err
+	}
+	tx, err := ls.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
-			log.Fatalf("batch: unable to rollback: %v", err)
+			log.Printf("batch: unable to rollback: %v\n", err)
 		}
 	}()
 
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO urls(id, lnk, usr) VALUES($1,$2,$3)")
+	if ls.Dedup != handler.DedupNone {
+		canons := make([]string, len(batch))
+		for n, i := range batch {
+			canons[n] = handler.CanonicalURL(i.URL)
+		}
+		if _, err := releaseExpired(ctx, tx, ls.scope("", user), canons); err != nil {
+			return nil, err
+		}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, insertLink)
 	if err != nil {
 		return nil, err
 	}
@@ -179,16 +497,37 @@ func (ls *LinkStore) Batch(ctx context.Context, batch []handler.BatchItem, user
 	res := make([]handler.ResultItem, 0, len(batch))
 
 	for _, i := range batch {
-		key := utils.RandString(ls.KeyLength)
-		if _, err = stmt.ExecContext(ctx, key, i.URL, user); err != nil {
-			return nil, err
+		if i.URL == "" {
+			return nil, fmt.Errorf("%w: %s", handler.ErrInvalidURL, i.ID)
 		}
-		shortURL := &url.URL{
-			Scheme: "http",
-			Host:   ls.Host(),
-			Path:   key,
+		var key string
+		in := keyInput(ctx, tx, i.URL, user)
+		for attempt := 0; key == ""; attempt++ {
+			if key, err = ls.newKey(i.Alias, in, attempt); err != nil {
+				return nil, err
+			}
+			err = stmt.QueryRowContext(ctx, key, i.URL, handler.CanonicalURL(i.URL), ls.scope(key, user), user, i.ExpiresAt).
+				Scan(&key)
+			switch {
+			case errors.Is(err, sql.ErrNoRows) && i.Alias != "":
+				return nil, fmt.Errorf("%w: %s", handler.ErrAliasTaken, i.Alias)
+			case errors.Is(err, sql.ErrNoRows):
+				same, err := holds(ctx, tx, key, i.URL, user)
+				if err != nil {
+					return nil, err
+				}
+				if same {
+					return nil, fmt.Errorf("%w: %s", handler.ErrConflict, i.URL)
+				}
+				key = ""
+			case err != nil:
+				if _, ok := uniqueViolation(err); ok {
+					return nil, fmt.Errorf("%w: %s", handler.ErrConflict, i.URL)
+				}
+				return nil, err
+			}
 		}
-		res = append(res, handler.ResultItem{ID: i.ID, URL: shortURL.String()})
+		res = append(res, handler.ResultItem{ID: i.ID, URL: ls.ShortURL(key)})
 	}
 
 	err = tx.Commit()
@@ -196,87 +535,193 @@ func (ls *LinkStore) Batch(ctx context.Context, batch []handler.BatchItem, user
 		return nil, err
 	}
 
+	ls.created(len(res))
 	return res, nil
 }
 
-func (ls *LinkStore) Delete(ctx context.Context, urls []string, user string) error {
-
-	tx, err := ls.db.Begin()
+// Delete marks the links of user with the given keys as removed with a
+// single statement, keys of other users are left untouched.
+func (ls *LinkStore) Delete(ctx context.Context, urls []string, user string) (map[string]handler.DeleteOutcome, error) {
+	outcomes, err := ls.DeleteBatch(ctx, []handler.Deletion{{User: user, Keys: urls}})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
-			log.Fatalf("batch: unable to rollback: %v", err)
-		}
-	}()
+	return outcomes[user], nil
+}
 
-	stmt, err := tx.PrepareContext(ctx, "UPDATE urls SET removed = true WHERE id = $1 AND usr = $2")
+// DeleteBatch marks the links of every deletion as removed with a single
+// statement, the keys are matched with their users by unnesting two
+// parallel arrays.
+func (ls *LinkStore) DeleteBatch(ctx context.Context, batch []handler.Deletion) (map[string]map[string]handler.DeleteOutcome, error) {
+	if err := ls.unopened(); err != nil {
+		return nil, err
+	}
+	outcomes := make(map[string]map[string]handler.DeleteOutcome, len(batch))
+	var keys, users []string
+	for _, d := range batch {
+		if outcomes[d.User] == nil {
+			outcomes[d.User] = make(map[string]handler.DeleteOutcome, len(d.Keys))
+		}
+		for _, key := range d.Keys {
+			outcomes[d.User][key] = handler.OutcomeNotFound
+			keys = append(keys, key)
+			users = append(users, d.User)
+		}
+	}
+	if len(keys) == 0 {
+		return outcomes, nil
+	}
+	rows, err := ls.db.QueryContext(ctx,
+		`WITH req AS (
+			SELECT DISTINCT id, usr FROM unnest($1::text[], $2::text[]) AS r(id, usr)
+		), deleted AS (
+			UPDATE urls SET removed = true, removed_at = coalesce(urls.removed_at, now())
+			FROM req WHERE urls.id = req.id AND urls.usr = req.usr RETURNING urls.id
+		)
+		SELECT req.id, req.usr, urls.usr = req.usr FROM req JOIN urls ON urls.id = req.id`,
+		pq.Array(keys), pq.Array(users))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	worker := func(url string) chan error {
-		ch := make(chan error)
-		go func() {
-			_, err := stmt.ExecContext(ctx, url, user)
-			if err != nil {
-				log.Printf("delete: unable to update table: %v", err)
-			}
-			ch <- err
-			close(ch)
-		}()
-		return ch
-	}
-
-	fanIn := func(chans []chan error) chan error {
-		res := make(chan error)
-		var wg sync.WaitGroup
-		wg.Add(len(chans))
-
-		for _, ch := range chans {
-			go func(ch chan error) {
-				defer wg.Done()
-				for err := range ch {
-					res <- err
-				}
-			}(ch)
+	for rows.Next() {
+		var key, user string
+		var owned bool
+		if err := rows.Scan(&key, &user, &owned); err != nil {
+			return nil, err
 		}
+		if owned {
+			outcomes[user][key] = handler.OutcomeDeleted
+		} else {
+			outcomes[user][key] = handler.OutcomeNotOwned
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
 
-		go func() {
-			wg.Wait()
-			close(res)
-		}()
-		return res
+func (ls *LinkStore) Restore(ctx context.Context, urls []string, user string, since time.Time) (map[string]handler.DeleteOutcome, error) {
+	if err := ls.unopened(); err != nil {
+		return nil, err
+	}
+	// the expired links holding the urls of the restored links let them go
+	_, err := ls.db.ExecContext(ctx,
+		`UPDATE urls o SET removed = true, removed_at = now() FROM urls r
+		WHERE r.id = ANY($1) AND r.usr = $2 AND o.scope = r.scope AND o.canon = r.canon
+			AND NOT o.removed AND o.expires_at <= now()`,
+		pq.Array(urls), user)
+	if err != nil {
+		return nil, err
 	}
 
-	var chans []chan error
-	for _, url := range urls {
-		ch := worker(url)
-		chans = append(chans, ch)
+	// a link whose url was shortened again after its deletion is not
+	// restored, nor are all but the last deleted of links sharing a url
+	rows, err := ls.db.QueryContext(ctx,
+		`WITH restored AS (
+			UPDATE urls SET removed = false, removed_at = NULL
+			WHERE id IN (
+				SELECT DISTINCT ON (r.scope, r.canon) r.id FROM urls r
+				WHERE r.id = ANY($1) AND r.usr = $2 AND r.removed AND r.removed_at >= $3
+					AND (r.expires_at IS NULL OR r.expires_at > now())
+					AND NOT EXISTS (SELECT 1 FROM urls o WHERE o.scope = r.scope AND o.canon = r.canon AND NOT o.removed)
+				ORDER BY r.scope, r.canon, r.removed_at DESC, r.id
+			)
+			RETURNING id
+		)
+		SELECT u.id, u.usr = $2, coalesce(u.removed AND u.removed_at < $3, false),
+			coalesce(u.expires_at <= now(), false), u.removed AND r.id IS NULL
+		FROM urls u LEFT JOIN restored r ON r.id = u.id WHERE u.id = ANY($1)`,
+		pq.Array(urls), user, since)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	ch := fanIn(chans)
-	for err := range ch {
-		if err != nil {
-			return err
+	outcomes := make(map[string]handler.DeleteOutcome, len(urls))
+	for _, key := range urls {
+		outcomes[key] = handler.OutcomeNotFound
+	}
+	for rows.Next() {
+		var key string
+		var owned, purging, expired, conflict bool
+		if err := rows.Scan(&key, &owned, &purging, &expired, &conflict); err != nil {
+			return nil, err
 		}
+		switch {
+		case !owned:
+			outcomes[key] = handler.OutcomeNotOwned
+		case purging:
+			// past the retention, waiting to be purged
+		case expired:
+			outcomes[key] = handler.OutcomeExpired
+		case conflict:
+			outcomes[key] = handler.OutcomeConflict
+		default:
+			outcomes[key] = handler.OutcomeRestored
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
+	return outcomes, nil
+}
 
-	err = tx.Commit()
+// Purge deletes the links removed before the given time together with
+// their clicks, so their urls can be shortened again, and returns how many
+// links were purged.
+func (ls *LinkStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	if err := ls.unopened(); err != nil {
+		return 0, err
+	}
+	tx, err := ls.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	return nil
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM clicks WHERE link IN (SELECT id FROM urls WHERE removed AND removed_at < $1)", before)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM urls WHERE removed AND removed_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
 }
 
-func (ls *LinkStore) Close() error {
-	if err := ls.Ping(context.Background()); err != nil {
-		return err
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
 	}
-	if err := ls.db.Close(); err != nil {
-		return err
+	return &t.Time
+}
+
+// ExpireLinks marks links expired by now as removed and returns how many
+// of them were marked.
+func (ls *LinkStore) ExpireLinks(ctx context.Context, now time.Time) (int64, error) {
+	if err := ls.unopened(); err != nil {
+		return 0, err
 	}
-	return nil
+	res, err := ls.db.ExecContext(ctx,
+		"UPDATE urls SET removed = true, removed_at = $1 WHERE expires_at <= $1 AND removed = false", now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (ls *LinkStore) Close() error {
+	if ls.db == nil {
+		return pq.ErrNotSupported
+	}
+	return ls.db.Close()
 }
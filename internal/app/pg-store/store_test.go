@@ -0,0 +1,203 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"github.com/AlLevykin/cutwell/internal/app/linkstest"
+	"github.com/AlLevykin/cutwell/internal/app/store"
+	"github.com/pressly/goose/v3"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBaseURL = handler.BaseURL{Scheme: "http", Host: "127.0.0.1:8080"}
+
+// newTestStore opens a store of config c on the database in
+// TEST_DATABASE_DSN, skipping the test when it isn't set, and truncates
+// the tables of that database.
+func newTestStore(t *testing.T, c store.Config) *LinkStore {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ls := NewLinkStore(c, dsn)
+	if err := ls.Ping(context.Background()); err != nil {
+		t.Fatalf("can't connect to %s: %v", dsn, err)
+	}
+	t.Cleanup(func() {
+		ls.Close()
+	})
+	if _, err := ls.db.Exec("TRUNCATE urls"); err != nil {
+		t.Fatalf("can't truncate tables: %v", err)
+	}
+	return ls
+}
+
+// TestLinkStore_Conformance runs against the database in TEST_DATABASE_DSN.
+// The tables of that database are truncated before every subtest.
+func TestLinkStore_Conformance(t *testing.T) {
+	linkstest.Run(t, func(t *testing.T, o linkstest.Options) handler.Links {
+		return newTestStore(t, store.Config{KeyLength: 9, BaseURL: testBaseURL, Dedup: o.Dedup, Keys: o.Keys})
+	})
+}
+
+func TestAddDedupScope(t *testing.T) {
+	ls := newTestStore(t, store.Config{KeyLength: 9, BaseURL: testBaseURL})
+	ctx := context.Background()
+
+	if err := goose.DownTo(ls.db, "migrations", 8); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ls.db.Exec(`INSERT INTO urls(id, lnk, usr) VALUES
+		('legacy', 'HTTP://Ya.Ru/a b', 'user'),
+		('held', 'http://ya.ru/c d', 'user'),
+		('modern', 'http://ya.ru/c%20d', 'user')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(ls.db, "migrations"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru/a%20b"}, "user")
+	var conflict *handler.ConflictError
+	if !errors.As(err, &conflict) || conflict.Key != "legacy" {
+		t.Errorf("Create() of a legacy url error = %v, want conflict on legacy", err)
+	}
+	var canon string
+	if err := ls.db.QueryRow("SELECT canon FROM urls WHERE id='held'").Scan(&canon); err != nil || canon != "http://ya.ru/c d" {
+		t.Errorf("canon of a link whose canonical form is held got %q, %v", canon, err)
+	}
+}
+
+// TestLinkStore_Unopened checks that a store whose database couldn't be
+// opened fails with the open error instead of panicking.
+func TestLinkStore_Unopened(t *testing.T) {
+	ls := NewLinkStore(store.Config{KeyLength: 9, BaseURL: testBaseURL},
+		"postgres://127.0.0.1:1/cutwell?sslmode=disable&connect_timeout=1")
+	ctx := context.Background()
+	calls := map[string]func() error{
+		"Create": func() error {
+			_, err := ls.Create(ctx, handler.Link{URL: "http://ya.ru"}, "user")
+			return err
+		},
+		"Find": func() error {
+			_, err := ls.Find(ctx, "http://ya.ru", "user")
+			return err
+		},
+		"Get": func() error {
+			_, err := ls.Get(ctx, "key")
+			return err
+		},
+		"GetURLList": func() error {
+			_, _, err := ls.GetURLList(ctx, "user", handler.ListQuery{Limit: 1})
+			return err
+		},
+		"RecordClicks": func() error {
+			return ls.RecordClicks(ctx, []handler.Click{{Key: "key", At: time.Now()}})
+		},
+		"ExpireLinks": func() error {
+			_, err := ls.ExpireLinks(ctx, time.Now())
+			return err
+		},
+		"DeleteBatch": func() error {
+			_, err := ls.DeleteBatch(ctx, []handler.Deletion{{User: "user", Keys: []string{"key"}}})
+			return err
+		},
+		"Restore": func() error {
+			_, err := ls.Restore(ctx, []string{"key"}, "user", time.Now())
+			return err
+		},
+		"Purge": func() error {
+			_, err := ls.Purge(ctx, time.Now())
+			return err
+		},
+		"Take": func() error {
+			_, err := ls.Take(ctx, []string{"key"}, handler.Limit{N: 1, Per: time.Minute}, 1)
+			return err
+		},
+		"Forget": func() error {
+			_, err := ls.Forget(ctx, time.Now())
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); err == nil || !strings.Contains(err.Error(), "migrations failed") {
+			t.Errorf("%s() of an unopened store got = %v, want the open error", name, err)
+		}
+	}
+}
+
+func TestLinkStore_KeyGeneratorError(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ls := NewLinkStore(store.Config{BaseURL: testBaseURL}, dsn)
+	defer ls.Close()
+	if err := ls.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "key generator") {
+		t.Errorf("Ping() of a store without keys got = %v, want the key generator error", err)
+	}
+}
+
+func TestLinkStore_Take(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ls := NewLinkStore(store.Config{KeyLength: 9, BaseURL: testBaseURL}, dsn)
+	if err := ls.Ping(context.Background()); err != nil {
+		t.Fatalf("can't connect to %s: %v", dsn, err)
+	}
+	defer ls.Close()
+	if _, err := ls.db.Exec("TRUNCATE rate_limits"); err != nil {
+		t.Fatalf("can't truncate rate_limits: %v", err)
+	}
+
+	ctx := context.Background()
+	l := handler.Limit{N: 2, Per: time.Hour}
+	for i, want := range []bool{true, true, false} {
+		a, err := ls.Take(ctx, []string{"key"}, l, 1)
+		if err != nil {
+			t.Fatalf("Take() error = %v", err)
+		}
+		if a.Allowed != want || a.Allowed && a.Remaining != 1-i {
+			t.Errorf("Take() #%d got = %+v, want allowed %v", i, a, want)
+		}
+	}
+	if a, err := ls.Take(ctx, []string{"other"}, l, 2); err != nil || !a.Allowed {
+		t.Errorf("Take() of another bucket got = %+v, %v", a, err)
+	}
+	if a, err := ls.Take(ctx, []string{"third", "key"}, l, 1); err != nil || a.Allowed {
+		t.Errorf("Take() of an empty bucket got = %+v, %v", a, err)
+	}
+	if a, err := ls.Take(ctx, []string{"third"}, l, 2); err != nil || !a.Allowed {
+		t.Errorf("Take() of a bucket whose take was denied got = %+v, %v", a, err)
+	}
+	n, err := ls.Forget(ctx, time.Now().Add(time.Minute))
+	if err != nil || n != 3 {
+		t.Errorf("Forget() got = %d, %v, want 3", n, err)
+	}
+}
+
+func TestLinkStore_Migrated(t *testing.T) {
+	ls := NewLinkStore(store.Config{KeyLength: 9, BaseURL: testBaseURL},
+		"postgres://127.0.0.1:1/cutwell?sslmode=disable&connect_timeout=1")
+	if err := ls.Migrated(context.Background()); err == nil {
+		t.Error("Migrated() of an unreachable database: want error")
+	}
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ls = NewLinkStore(store.Config{KeyLength: 9, BaseURL: testBaseURL}, dsn)
+	defer ls.Close()
+	if err := ls.Migrated(context.Background()); err != nil {
+		t.Errorf("Migrated() error = %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+// Package policy blocks and allows the target hosts of short links by rules
+// read from a file. Every line of the file is a rule:
+//
+//	# comments and empty lines are ignored
+//	block evil.com        # the host itself
+//	block *.evil.com      # its subdomains at any depth
+//	block 203.0.113.0/24  # ip literal hosts in the range
+//	block re:^paypa[l1]-  # hosts matching the regular expression
+//	allow safe.evil.com
+//
+// Allow rules take precedence over block rules, so "block *" followed by
+// allow rules turns the file into an allowlist.
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"golang.org/x/net/idna"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	actionAllow = "allow"
+	actionBlock = "block"
+)
+
+type rule struct {
+	action string
+	source string
+	match  func(host string, ip net.IP) bool
+}
+
+type Policy struct {
+	rules []rule
+}
+
+func Parse(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || fields[0] != actionAllow && fields[0] != actionBlock {
+			return nil, fmt.Errorf("line %d: want \"allow|block pattern\", got %q", n, line)
+		}
+		match, err := matcher(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		p.rules = append(p.rules, rule{action: fields[0], source: fields[1], match: match})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// stripComment cuts a comment off line. A comment starts with # at the
+// start of the line or after a blank, so # within a pattern is kept.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func matcher(pattern string) (func(host string, ip net.IP) bool, error) {
+	if expr := strings.TrimPrefix(pattern, "re:"); expr != pattern {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(host string, ip net.IP) bool {
+			return re.MatchString(host)
+		}, nil
+	}
+	if pattern == "*" {
+		return func(host string, ip net.IP) bool {
+			return true
+		}, nil
+	}
+	if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+		return func(host string, ip net.IP) bool {
+			return ip != nil && ipnet.Contains(ip)
+		}, nil
+	}
+	if rip := net.ParseIP(pattern); rip != nil {
+		return func(host string, ip net.IP) bool {
+			return ip != nil && rip.Equal(ip)
+		}, nil
+	}
+	domain := strings.TrimPrefix(pattern, "*.")
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain %q: %w", pattern, err)
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := "." + domain
+		return func(host string, ip net.IP) bool {
+			return strings.HasSuffix(host, suffix)
+		}, nil
+	}
+	return func(host string, ip net.IP) bool {
+		return host == domain
+	}, nil
+}
+
+// Check returns an error wrapping handler.ErrBlocked when host matches a
+// block rule and no allow rule.
+func (p *Policy) Check(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := parseIP(host)
+	blocked := ""
+	for _, r := range p.rules {
+		if !r.match(host, ip) {
+			continue
+		}
+		if r.action == actionAllow {
+			return nil
+		}
+		if blocked == "" {
+			blocked = r.source
+		}
+	}
+	if blocked != "" {
+		return fmt.Errorf("%w: %s matches %s", handler.ErrBlocked, host, blocked)
+	}
+	return nil
+}
+
+// parseIP parses an ip literal host. Besides the forms net.ParseIP takes, it
+// takes the IPv4 forms inet_aton does and resolvers pass on, such as
+// 3405803777, 0xcb.0.113.1, 0313.0.0161.1 or 203.7281, so that they can't
+// slip past the ip rules.
+func parseIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	var addr uint64
+	for i, part := range parts[:len(parts)-1] {
+		n, ok := parseInetPart(part)
+		if !ok || n > 0xff {
+			return nil
+		}
+		addr |= n << (8 * (3 - i))
+	}
+	// the last part fills the bytes the parts before it leave
+	n, ok := parseInetPart(parts[len(parts)-1])
+	if !ok || n >= 1<<(8*(5-len(parts))) {
+		return nil
+	}
+	addr |= n
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+// parseInetPart parses a part of an inet_aton address: decimal, octal with
+// a leading 0 or hexadecimal with a leading 0x.
+func parseInetPart(s string) (uint64, bool) {
+	base := 10
+	switch {
+	case len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X"):
+		base, s = 16, s[2:]
+	case len(s) > 1 && s[0] == '0':
+		base, s = 8, s[1:]
+	}
+	if s == "" {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range s {
+		var d uint64
+		switch {
+		case '0' <= c && c <= '9':
+			d = uint64(c - '0')
+		case base == 16 && 'a' <= c && c <= 'f':
+			d = uint64(c-'a') + 10
+		case base == 16 && 'A' <= c && c <= 'F':
+			d = uint64(c-'A') + 10
+		default:
+			return 0, false
+		}
+		if d >= uint64(base) {
+			return 0, false
+		}
+		n = n*uint64(base) + d
+		if n > 0xffffffff {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// File is the policy kept in a file, which can be reloaded while it is
+// checked.
+type File struct {
+	path    string
+	current atomic.Value
+}
+
+func Open(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again. On error the policy loaded before is kept.
+func (f *File) Reload() error {
+	p, err := Load(f.path)
+	if err != nil {
+		return err
+	}
+	f.current.Store(p)
+	return nil
+}
+
+func (f *File) Check(host string) error {
+	return f.current.Load().(*Policy).Check(host)
+}
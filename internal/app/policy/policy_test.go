@@ -0,0 +1,153 @@
+package policy
+
+import (
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicy_Check(t *testing.T) {
+	rules := `
+# test rules
+block evil.com
+block *.bad.org   # subdomains only
+block 203.0.113.0/24
+block 2001:db8::1
+block re:^paypa[l1]-
+block re:^x#y\.com$  # a regexp with #
+block *.пример.рф
+allow good.bad.org
+`
+	p, err := Parse(strings.NewReader(rules))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		host    string
+		blocked bool
+	}{
+		{"exact", "evil.com", true},
+		{"exact case", "EVIL.com", true},
+		{"exact trailing dot", "evil.com.", true},
+		{"exact subdomain", "www.evil.com", false},
+		{"exact suffix", "notevil.com", false},
+		{"wildcard", "www.bad.org", true},
+		{"wildcard deep", "a.b.bad.org", true},
+		{"wildcard apex", "bad.org", false},
+		{"allow", "good.bad.org", false},
+		{"cidr", "203.0.113.7", true},
+		{"cidr outside", "203.0.114.7", false},
+		{"cidr decimal", "3405803777", true},
+		{"cidr hex", "0xcb.0.113.1", true},
+		{"cidr octal", "0313.0.0161.1", true},
+		{"cidr short", "203.0.28929", true},
+		{"cidr short outside", "203.0.29185", false},
+		{"cidr two parts", "203.28929", true},
+		{"cidr hex whole", "0xCB007101", true},
+		{"not ip bad octal", "0318.0.113.1", false},
+		{"not ip part too big", "203.256.113.1", false},
+		{"not ip too many parts", "203.0.113.1.1", false},
+		{"ip", "2001:db8::1", true},
+		{"regexp", "paypa1-login.com", true},
+		{"regexp with #", "x#y.com", true},
+		{"idn", "xn--e1afmkfd.xn--e1afmkfd.xn--p1ai", true},
+		{"other", "ya.ru", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.host)
+			if (err != nil) != tt.blocked {
+				t.Fatalf("Check() error = %v, blocked %v", err, tt.blocked)
+			}
+			if err != nil && !errors.Is(err, handler.ErrBlocked) {
+				t.Errorf("Check() error = %v, want %v", err, handler.ErrBlocked)
+			}
+		})
+	}
+}
+
+func TestPolicy_Allowlist(t *testing.T) {
+	p, err := Parse(strings.NewReader("block *\nallow ya.ru\nallow *.ya.ru\n"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	for host, blocked := range map[string]bool{"ya.ru": false, "mail.ya.ru": false, "evil.com": true, "127.0.0.1": true} {
+		if err := p.Check(host); (err != nil) != blocked {
+			t.Errorf("Check(%q) error = %v, blocked %v", host, err, blocked)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"comments", "# nothing\n\n  # here\n", ""},
+		{"comment after tab", "block evil.com\t# evil", ""},
+		{"# in pattern", "block evil#com", "line 1"},
+		{"unknown action", "deny evil.com", "line 1"},
+		{"no pattern", "\nblock", "line 2"},
+		{"extra field", "block a.com b.com", "line 1"},
+		{"bad regexp", "block re:(", "line 1"},
+		{"bad domain", "block xn--a.com", "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.rules))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Parse() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFile_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	write := func(rules string) {
+		if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Open(path); err == nil {
+		t.Fatal("Open() of a missing file: want error")
+	}
+
+	write("block evil.com\n")
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if f.Check("evil.com") == nil {
+		t.Error("Check(evil.com): want blocked")
+	}
+
+	write("block ya.ru\n")
+	if err := f.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if f.Check("evil.com") != nil || f.Check("ya.ru") == nil {
+		t.Error("Reload() did not replace the rules")
+	}
+
+	write("block re:(\n")
+	if err := f.Reload(); err == nil {
+		t.Fatal("Reload() of a broken file: want error")
+	}
+	if f.Check("ya.ru") == nil {
+		t.Error("Reload() error dropped the loaded rules")
+	}
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"sort"
+	"time"
+)
+
+// clickStats returns the counts of the clicks on key. The counts take space
+// by the days, referrers, user agents and visitors of a link, not by its
+// traffic.
+func (ls *LinkStore) clickStats(key string) *statsEntry {
+	if ls.clicks == nil {
+		ls.clicks = make(map[string]*statsEntry)
+	}
+	st, ok := ls.clicks[key]
+	if !ok {
+		st = &statsEntry{
+			Key:        key,
+			Daily:      make(map[string]int64),
+			Referrers:  make(map[string]int64),
+			UserAgents: make(map[string]int64),
+			IPHashes:   make(map[string]int64),
+		}
+		ls.clicks[key] = st
+	}
+	return st
+}
+
+func (ls *LinkStore) applyClicks(clicks []clickEntry) {
+	for _, c := range clicks {
+		st := ls.clickStats(c.Key)
+		st.Total++
+		st.Daily[c.At.UTC().Format(handler.StatsDateLayout)]++
+		st.Referrers[c.Referrer]++
+		st.UserAgents[c.UserAgent]++
+		if c.IPHash != "" {
+			st.IPHashes[c.IPHash]++
+		}
+	}
+}
+
+func (ls *LinkStore) applyClickStats(stats []statsEntry) {
+	for _, e := range stats {
+		st := ls.clickStats(e.Key)
+		st.Total += e.Total
+		for day, n := range e.Daily {
+			st.Daily[day] += n
+		}
+		for ref, n := range e.Referrers {
+			st.Referrers[ref] += n
+		}
+		for ua, n := range e.UserAgents {
+			st.UserAgents[ua] += n
+		}
+		for ip, n := range e.IPHashes {
+			st.IPHashes[ip] += n
+		}
+	}
+}
+
+func (ls *LinkStore) RecordClicks(ctx context.Context, clicks []handler.Click) error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	r := record{Op: opClick, Clicks: make([]clickEntry, 0, len(clicks))}
+	for _, c := range clicks {
+		r.Clicks = append(r.Clicks, newClickEntry(c))
+	}
+	return ls.commit(r)
+}
+
+func (ls *LinkStore) Stats(ctx context.Context, key string, user string, since time.Time) (*handler.Stats, error) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if _, ok := ls.Mem[key]; !ok {
+		return nil, handler.ErrNotFound
+	}
+	if ls.Users[key] != user {
+		return nil, handler.ErrForbidden
+	}
+
+	from := since.UTC().Format(handler.StatsDateLayout)
+	stats := &handler.Stats{
+		Daily:      make([]handler.DailyClicks, 0),
+		Referrers:  make([]handler.ReferrerCount, 0),
+		UserAgents: make([]handler.UserAgentCount, 0),
+	}
+	st, ok := ls.clicks[key]
+	if !ok {
+		return stats, nil
+	}
+	stats.Total = st.Total
+	stats.Visitors = int64(len(st.IPHashes))
+	for day, n := range st.Daily {
+		if day >= from {
+			stats.Daily = append(stats.Daily, handler.DailyClicks{Date: day, Clicks: n})
+		}
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+	for _, ref := range top(st.Referrers) {
+		stats.Referrers = append(stats.Referrers, handler.ReferrerCount{Referrer: ref, Clicks: st.Referrers[ref]})
+	}
+	for _, ua := range top(st.UserAgents) {
+		stats.UserAgents = append(stats.UserAgents, handler.UserAgentCount{UserAgent: ua, Clicks: st.UserAgents[ua]})
+	}
+	return stats, nil
+}
+
+func top(counts map[string]int64) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := counts[keys[i]], counts[keys[j]]
+		return a > b || a == b && keys[i] < keys[j]
+	})
+	if len(keys) > handler.TopReferrers {
+		keys = keys[:handler.TopReferrers]
+	}
+	return keys
+}
+
+func (ls *LinkStore) clickSnapshot() []record {
+	var recs []record
+	r := record{Op: opClickStats}
+	for _, st := range ls.clicks {
+		r.Stats = append(r.Stats, *st)
+		if len(r.Stats) == snapshotChunk {
+			recs = append(recs, r)
+			r = record{Op: opClickStats}
+		}
+	}
+	if len(r.Stats) != 0 {
+		recs = append(recs, r)
+	}
+	return recs
+}
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opCreate  = "create"
+	opDelete  = "delete"
+	opClick   = "click"
+	opRestore = "restore"
+	opPurge   = "purge"
+	// opClickStats holds the clicks of links rolled up on compaction.
+	opClickStats = "click_stats"
+)
+
+type entry struct {
+	Key       string     `json:"key"`
+	URL       string     `json:"url,omitempty"`
+	User      string     `json:"user,omitempty"`
+	Removed   bool       `json:"removed,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+}
+
+type clickEntry struct {
+	Key       string    `json:"key"`
+	At        time.Time `json:"at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+}
+
+func newClickEntry(c handler.Click) clickEntry {
+	return clickEntry{
+		Key:       c.Key,
+		At:        c.At,
+		Referrer:  c.Referrer,
+		UserAgent: c.UserAgent,
+		IPHash:    c.IPHash,
+	}
+}
+
+// statsEntry is the clicks of a link rolled up by day, referrer, user
+// agent and client address hash.
+type statsEntry struct {
+	Key        string           `json:"key"`
+	Total      int64            `json:"total"`
+	Daily      map[string]int64 `json:"daily,omitempty"`
+	Referrers  map[string]int64 `json:"referrers,omitempty"`
+	UserAgents map[string]int64 `json:"user_agents,omitempty"`
+	IPHashes   map[string]int64 `json:"ip_hashes,omitempty"`
+}
+
+// record is one line of the journal. All entries of a record are written
+// with a single write, so a batch is either replayed as a whole or, when
+// the process dies in the middle of the write, dropped as a torn record.
+type record struct {
+	Op     string       `json:"op"`
+	Links  []entry      `json:"links,omitempty"`
+	Clicks []clickEntry `json:"clicks,omitempty"`
+	Stats  []statsEntry `json:"stats,omitempty"`
+	// Seq is the counter of sequential keys after the record.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+var errLegacyFormat = errors.New("legacy storage format")
+
+// Journal is an append-only log of link store changes kept in a file with
+// one JSON record per line.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Replay reads the journal from the beginning and calls apply for every
+// record. A torn last record, left by a crash in the middle of a write, is
+// cut off so that the next append starts on a clean line. A last line that
+// can't be the start of a record is reported instead, it may be a damaged
+// legacy file which must not be discarded.
+func (j *Journal) Replay(apply func(r record)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(j.file)
+	var offset int64
+	for n := 0; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+		var r record
+		if decodeErr := json.Unmarshal(bytes.TrimSpace(line), &r); decodeErr != nil || r.Op == "" {
+			if n == 0 && decodeErr == nil {
+				return errLegacyFormat
+			}
+			if (err == io.EOF || isLastLine(reader)) && isTorn(line) {
+				return j.file.Truncate(offset)
+			}
+			return fmt.Errorf("journal %s: corrupted record at offset %d", j.path, offset)
+		}
+		apply(r)
+		offset += int64(len(line))
+		if err == io.EOF {
+			// the record is complete but not terminated, terminate it
+			// before appending the next one
+			_, err = j.file.Write([]byte("\n"))
+			return err
+		}
+	}
+	return nil
+}
+
+// recordPrefix is how every record starts, Op is encoded first.
+var recordPrefix = []byte(`{"op":"`)
+
+func isTorn(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) < len(recordPrefix) {
+		return bytes.HasPrefix(recordPrefix, line)
+	}
+	return bytes.HasPrefix(line, recordPrefix)
+}
+
+func isLastLine(reader *bufio.Reader) bool {
+	_, err := reader.Peek(1)
+	return err == io.EOF
+}
+
+// Append writes records to the end of the journal and syncs it, so that a
+// change is on disk before the store acknowledges it.
+func (j *Journal) Append(recs ...record) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, r := range recs {
+		if err := encoder.Encode(&r); err != nil {
+			return err
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Compact replaces the journal with recs. The new journal is written to a
+// temporary file which is then atomically renamed over the old one.
+func (j *Journal) Compact(recs []record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, r := range recs {
+		if err := encoder.Encode(&r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(j.path))
+
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	return nil
+}
+
+// syncDir flushes the directory entry of a renamed file. It is best effort:
+// not every platform allows to sync a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Writable checks that the directory of the journal accepts new files, as
+// compaction needs, by writing and removing a probe file.
+func (j *Journal) Writable() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	probe, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*.probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(probe.Name())
+	if _, err := probe.Write([]byte{'\n'}); err != nil {
+		probe.Close()
+		return err
+	}
+	return probe.Close()
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"github.com/AlLevykin/cutwell/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBaseURL = handler.BaseURL{Scheme: "http", Host: "127.0.0.1:8080"}
+
+func openStore(t *testing.T, fileName string) *LinkStore {
+	t.Helper()
+	ls, err := NewLinkStore(Config{KeyLength: 9, BaseURL: testBaseURL}, fileName)
+	if err != nil {
+		t.Fatalf("NewLinkStore() error = %v", err)
+	}
+	return ls
+}
+
+func TestLinkStore_Replay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+
+	ls := openStore(t, fileName)
+	created, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := ls.Batch(ctx, []handler.BatchItem{{ID: "1", URL: "google.com"}}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Delete(ctx, []string{created}, "000001"); err != nil {
+		t.Fatal(err)
+	}
+	// no Close: the journal must survive a crash
+
+	ls = openStore(t, fileName)
+	defer ls.Close()
+	if _, err := ls.Get(ctx, created); !errors.Is(err, handler.ErrGone) {
+		t.Errorf("Get() of deleted link error = %v, want %v", err, handler.ErrGone)
+	}
+	key := batch[0].URL[strings.LastIndex(batch[0].URL, "/")+1:]
+	if got, err := ls.Get(ctx, key); err != nil || got != "google.com" {
+		t.Errorf("Get() of batch link = %v, %v", got, err)
+	}
+}
+
+func TestLinkStore_TornRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+
+	ls := openStore(t, fileName)
+	key, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"op":"create","links":[{"key":"abc","url":"goo`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ls = openStore(t, fileName)
+	if _, err := ls.Get(ctx, key); err != nil {
+		t.Errorf("Get() error = %v", err)
+	}
+	if _, err := ls.Get(ctx, "abc"); !errors.Is(err, handler.ErrNotFound) {
+		t.Errorf("Get() of torn link error = %v, want %v", err, handler.ErrNotFound)
+	}
+	next, err := ls.Create(ctx, handler.Link{URL: "google.com"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls = openStore(t, fileName)
+	defer ls.Close()
+	if got, err := ls.Get(ctx, next); err != nil || got != "google.com" {
+		t.Errorf("Get() after torn record = %v, %v", got, err)
+	}
+}
+
+func TestLinkStore_Compact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+
+	ls := openStore(t, fileName)
+	keys := make([]string, 0, 3)
+	for _, lnk := range []string{"ya.ru", "google.com", "yandex.ru"} {
+		key, err := ls.Create(ctx, handler.Link{URL: lnk}, "000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := ls.Delete(ctx, keys[:1], "000001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 1 {
+		t.Errorf("Compact() left %d records, want 1", lines)
+	}
+	if _, err := ls.Create(ctx, handler.Link{URL: "mail.ru"}, "000001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	ls = openStore(t, fileName)
+	defer ls.Close()
+	if _, err := ls.Get(ctx, keys[0]); !errors.Is(err, handler.ErrGone) {
+		t.Errorf("Get() of deleted link error = %v, want %v", err, handler.ErrGone)
+	}
+	if _, err := ls.Find(ctx, "mail.ru", "000001"); err != nil {
+		t.Errorf("Find() of link created after compaction error = %v", err)
+	}
+}
+
+func TestLinkStore_DamagedLegacyFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	damaged := []byte(`{"abc":"ya.ru","def":"goo`)
+	if err := os.WriteFile(fileName, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLinkStore(Config{KeyLength: 9, BaseURL: testBaseURL}, fileName); err == nil {
+		t.Error("NewLinkStore() of a damaged legacy file: want error")
+	}
+	if b, err := os.ReadFile(fileName); err != nil || string(b) != string(damaged) {
+		t.Errorf("NewLinkStore() changed a damaged legacy file to %q, %v", b, err)
+	}
+}
+
+func TestLinkStore_ReplayDeletedDedup(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+
+	ls := openStore(t, fileName)
+	deleted, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Delete(ctx, []string{deleted}, "000001"); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the link holding the url must win over the deleted one after a crash
+	// and after a compaction, whatever order they are replayed in
+	for _, compact := range []bool{false, true} {
+		if compact {
+			if err := ls.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ls = openStore(t, fileName)
+		if got, err := ls.Find(ctx, "ya.ru", "000001"); err != nil || got != again {
+			t.Errorf("Find() after replay, compacted %v = %v, %v, want %v", compact, got, err, again)
+		}
+	}
+	ls.Close()
+}
+
+func TestLinkStore_LegacyImport(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(fileName, []byte(`{"abc":"ya.ru"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName+".users", []byte(`{"abc":"000001"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ls := openStore(t, fileName)
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ls = openStore(t, fileName)
+	defer ls.Close()
+	if got, err := ls.Get(context.Background(), "abc"); err != nil || got != "ya.ru" {
+		t.Errorf("Get() of imported link = %v, %v", got, err)
+	}
+	if got, _, err := ls.GetURLList(context.Background(), "000001", handler.ListQuery{Limit: handler.DefaultListLimit}); err != nil || len(got) != 1 {
+		t.Errorf("GetURLList() of imported user = %v, %v", got, err)
+	}
+}
+
+func TestLinkStore_ReplaySeq(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+	keys, err := utils.NewSequentialKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() *LinkStore {
+		ls, err := NewLinkStore(Config{BaseURL: testBaseURL, Keys: keys}, fileName)
+		if err != nil {
+			t.Fatalf("NewLinkStore() error = %v", err)
+		}
+		return ls
+	}
+
+	ls := open()
+	for _, lnk := range []string{"http://ya.ru/1", "http://ya.ru/2"} {
+		if _, err := ls.Create(ctx, handler.Link{URL: lnk}, "000001"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ls.Purge(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the counter must survive a crash
+	ls = open()
+	key, err := ls.Create(ctx, handler.Link{URL: "http://ya.ru/3"}, "000001")
+	if err != nil || key != "3" {
+		t.Fatalf("Create() after replay = %v, %v, want 3", key, err)
+	}
+
+	// and a compaction that drops every link
+	if _, err := ls.Delete(ctx, []string{"1", "2", "3"}, "000001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Purge(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ls = open()
+	defer ls.Close()
+	if key, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru/4"}, "000001"); err != nil || key != "4" {
+		t.Errorf("Create() after compaction = %v, %v, want 4", key, err)
+	}
+}
+
+func TestLinkStore_Writable(t *testing.T) {
+	dir := t.TempDir()
+	ls, err := NewLinkStore(Config{KeyLength: 9, BaseURL: testBaseURL}, filepath.Join(dir, "links"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.journal.Close()
+	if err = ls.Writable(context.Background()); err != nil {
+		t.Fatalf("Writable() error = %v", err)
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = ls.Writable(context.Background()); err == nil {
+		t.Error("Writable() without a directory: want error")
+	}
+}
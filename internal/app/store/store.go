@@ -2,54 +2,467 @@ package store
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/AlLevykin/cutwell/internal/api/handler"
 	"github.com/AlLevykin/cutwell/internal/utils"
-	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
-	BaseURL   string
+	// BaseURL is the root of the short urls of the store.
+	BaseURL   handler.BaseURL
 	KeyLength int
+	// Dedup is the scope of duplicate links, DedupGlobal when empty.
+	Dedup handler.DedupScope
+	// Keys generates the keys of links, random keys of KeyLength when nil.
+	Keys utils.KeyGenerator
+	// Hooks is notified of the links stored, for metrics.
+	Hooks handler.LinkHooks
 }
 
+// KeyGenerator returns the key generator of the config.
+func (c Config) KeyGenerator() (utils.KeyGenerator, error) {
+	if c.Keys != nil {
+		return c.Keys, nil
+	}
+	return utils.NewRandomKeys(utils.RandomKeysConfig{Length: c.KeyLength})
+}
+
+// snapshotChunk is the number of links written per record on compaction.
+const snapshotChunk = 1000
+
+// LinkStore keeps links in memory. When a file name is given, every change
+// is appended to a journal in that file before it is applied, and the
+// journal is replayed on startup.
 type LinkStore struct {
 	sync.Mutex
 	File      string
 	Mem       map[string]string
 	Users     map[string]string
+	Removed   map[string]bool
+	Expires   map[string]time.Time
+	Created   map[string]time.Time
+	RemovedAt map[string]time.Time
 	KeyLength int
-	BaseURL   string
+	BaseURL   handler.BaseURL
+	Dedup     handler.DedupScope
+	Keys      utils.KeyGenerator
+	Seq       uint64
+	Hooks     handler.LinkHooks
+	links     map[string]string
+	byUser    map[string][]string
+	clicks    map[string]*statsEntry
+	journal   *Journal
 }
 
-func NewLinkStore(c Config, fileName string) *LinkStore {
-	return &LinkStore{
+func NewLinkStore(c Config, fileName string) (*LinkStore, error) {
+	ls := &LinkStore{
 		File:      fileName,
-		Mem:       FileToMap(fileName),
-		Users:     FileToMap(fileName + ".users"),
+		Mem:       make(map[string]string),
+		Users:     make(map[string]string),
+		Removed:   make(map[string]bool),
+		Expires:   make(map[string]time.Time),
+		Created:   make(map[string]time.Time),
+		RemovedAt: make(map[string]time.Time),
 		KeyLength: c.KeyLength,
 		BaseURL:   c.BaseURL,
+		Dedup:     c.Dedup,
+		Keys:      c.Keys,
+		Hooks:     c.Hooks,
+	}
+	if fileName == "" {
+		return ls, nil
+	}
+
+	j, err := OpenJournal(fileName)
+	if err != nil {
+		return nil, err
+	}
+	ls.journal = j
+	err = j.Replay(ls.apply)
+	if errors.Is(err, errLegacyFormat) {
+		ls.Mem = FileToMap(fileName)
+		ls.Users = FileToMap(fileName + ".users")
+		ls.Removed = FileToBoolMap(fileName + ".removed")
+		now := time.Now().UTC()
+		for key := range ls.Removed {
+			ls.RemovedAt[key] = now
+		}
+		err = ls.Compact()
+	}
+	if err != nil {
+		j.Close()
+		return nil, err
+	}
+	return ls, nil
+}
+
+// apply changes the in-memory state according to a journal record.
+func (ls *LinkStore) apply(r record) {
+	if r.Seq > ls.Seq {
+		ls.Seq = r.Seq
+	}
+	switch r.Op {
+	case opCreate:
+		for _, e := range r.Links {
+			byUser := ls.userIndex()
+			ls.Mem[e.Key] = e.URL
+			ls.Users[e.Key] = e.User
+			if !e.CreatedAt.IsZero() {
+				if ls.Created == nil {
+					ls.Created = make(map[string]time.Time)
+				}
+				ls.Created[e.Key] = e.CreatedAt
+			}
+			byUser[e.User] = ls.insertSorted(byUser[e.User], e.Key)
+			if e.Removed {
+				ls.remove(e.Key, e.RemovedAt)
+			}
+			if e.ExpiresAt != nil {
+				ls.Expires[e.Key] = *e.ExpiresAt
+			}
+			if dk, ok := ls.dedupKey(e.User, e.URL); ok {
+				ls.hold(dk, e.Key)
+			}
+		}
+	case opDelete:
+		for _, e := range r.Links {
+			if owner, ok := ls.Users[e.Key]; ok && owner == e.User {
+				ls.remove(e.Key, e.RemovedAt)
+			}
+		}
+	case opRestore:
+		for _, e := range r.Links {
+			if owner, ok := ls.Users[e.Key]; ok && owner == e.User {
+				delete(ls.Removed, e.Key)
+				delete(ls.RemovedAt, e.Key)
+				if dk, ok := ls.dedupKey(owner, ls.Mem[e.Key]); ok {
+					ls.hold(dk, e.Key)
+				}
+			}
+		}
+	case opPurge:
+		for _, e := range r.Links {
+			ls.purge(e.Key)
+		}
+	case opClick:
+		ls.applyClicks(r.Clicks)
+	case opClickStats:
+		ls.applyClickStats(r.Stats)
+	}
+}
+
+// remove marks key as removed at the given time. Records written before
+// removal times were journaled start the retention period now.
+func (ls *LinkStore) remove(key string, at *time.Time) {
+	if ls.RemovedAt == nil {
+		ls.RemovedAt = make(map[string]time.Time)
+	}
+	ls.Removed[key] = true
+	if at != nil {
+		ls.RemovedAt[key] = *at
+	} else if _, ok := ls.RemovedAt[key]; !ok {
+		ls.RemovedAt[key] = time.Now().UTC()
 	}
 }
 
-func (ls *LinkStore) Delete(ctx context.Context, urls []string, user string) error {
+// purge forgets everything about key.
+func (ls *LinkStore) purge(key string) {
+	lnk, ok := ls.Mem[key]
+	if !ok {
+		return
+	}
+	if dk, ok := ls.dedupKey(ls.Users[key], lnk); ok && ls.links != nil && ls.links[dk] == key {
+		delete(ls.links, dk)
+	}
+	if ls.byUser != nil {
+		user := ls.Users[key]
+		keys := ls.byUser[user]
+		for i, k := range keys {
+			if k == key {
+				ls.byUser[user] = append(keys[:i], keys[i+1:]...)
+				break
+			}
+		}
+		if len(ls.byUser[user]) == 0 {
+			delete(ls.byUser, user)
+		}
+	}
+	delete(ls.Mem, key)
+	delete(ls.Users, key)
+	delete(ls.Removed, key)
+	delete(ls.RemovedAt, key)
+	delete(ls.Expires, key)
+	delete(ls.Created, key)
+	delete(ls.clicks, key)
+}
+
+// commit writes r to the journal, if there is one, and applies it.
+func (ls *LinkStore) commit(r record) error {
+	if ls.journal != nil {
+		if err := ls.journal.Append(r); err != nil {
+			return err
+		}
+	}
+	ls.apply(r)
 	return nil
 }
 
+// index returns the dedup key to key index used for duplicate detection,
+// building it from Mem on first use.
+func (ls *LinkStore) index() map[string]string {
+	if ls.links == nil {
+		ls.links = make(map[string]string, len(ls.Mem))
+		for key, lnk := range ls.Mem {
+			if dk, ok := ls.dedupKey(ls.Users[key], lnk); ok {
+				ls.hold(dk, key)
+			}
+		}
+	}
+	return ls.links
+}
+
+// hold indexes key under the dedup key dk unless a link holding its url
+// is indexed there already.
+func (ls *LinkStore) hold(dk, key string) {
+	index := ls.index()
+	if held, ok := index[dk]; !ok || !ls.holds(held) || ls.holds(key) {
+		index[dk] = key
+	}
+}
+
+// holds reports whether the link key holds its url, so that shortening
+// the url again is a duplicate. Removed and expired links don't, even
+// before ExpireLinks marks them as removed.
+func (ls *LinkStore) holds(key string) bool {
+	return !ls.Removed[key] && !ls.expired(key, time.Now())
+}
+
+// holder returns the key of the link holding the url with the dedup key dk.
+func (ls *LinkStore) holder(dk string) (string, bool) {
+	key, ok := ls.index()[dk]
+	if !ok || !ls.holds(key) {
+		return "", false
+	}
+	return key, true
+}
+
+// dedupKey returns the key under which lnk of user is deduplicated, it
+// reports false when links are never deduplicated.
+func (ls *LinkStore) dedupKey(user, lnk string) (string, bool) {
+	switch ls.Dedup {
+	case handler.DedupNone:
+		return "", false
+	case handler.DedupUser:
+		return user + "\n" + handler.CanonicalURL(lnk), true
+	}
+	return handler.CanonicalURL(lnk), true
+}
+
+// duplicate reports whether lnk of user is a duplicate of the stored key.
+func (ls *LinkStore) duplicate(key, user, lnk string) bool {
+	stored, ok := ls.dedupKey(ls.Users[key], ls.Mem[key])
+	dk, _ := ls.dedupKey(user, lnk)
+	return ok && stored == dk && ls.holds(key)
+}
+
+// userIndex returns the keys of every user ordered by creation time,
+// building it from Users on first use.
+func (ls *LinkStore) userIndex() map[string][]string {
+	if ls.byUser == nil {
+		ls.byUser = make(map[string][]string)
+		for key, user := range ls.Users {
+			ls.byUser[user] = append(ls.byUser[user], key)
+		}
+		for _, keys := range ls.byUser {
+			sort.Slice(keys, func(i, j int) bool {
+				return ls.less(keys[i], keys[j])
+			})
+		}
+	}
+	return ls.byUser
+}
+
+// less orders keys by creation time and then by key.
+func (ls *LinkStore) less(a, b string) bool {
+	ta, tb := ls.Created[a], ls.Created[b]
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return a < b
+}
+
+// insertSorted inserts key into keys keeping them in creation order. New
+// links are created last, so this is usually an append.
+func (ls *LinkStore) insertSorted(keys []string, key string) []string {
+	n := len(keys)
+	if n == 0 || ls.less(keys[n-1], key) {
+		return append(keys, key)
+	}
+	i := sort.Search(n, func(i int) bool { return !ls.less(keys[i], key) })
+	if i < n && keys[i] == key {
+		return keys
+	}
+	keys = append(keys, "")
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+func (ls *LinkStore) Delete(ctx context.Context, urls []string, user string) (map[string]handler.DeleteOutcome, error) {
+	outcomes, err := ls.DeleteBatch(ctx, []handler.Deletion{{User: user, Keys: urls}})
+	if err != nil {
+		return nil, err
+	}
+	return outcomes[user], nil
+}
+
+// DeleteBatch removes the links of every deletion with a single journal
+// record.
+func (ls *LinkStore) DeleteBatch(ctx context.Context, batch []handler.Deletion) (map[string]map[string]handler.DeleteOutcome, error) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if ls.Removed == nil {
+		ls.Removed = make(map[string]bool)
+	}
+	outcomes := make(map[string]map[string]handler.DeleteOutcome, len(batch))
+	removing := make(map[string]bool)
+	now := time.Now().UTC()
+	r := record{Op: opDelete}
+	for _, d := range batch {
+		if outcomes[d.User] == nil {
+			outcomes[d.User] = make(map[string]handler.DeleteOutcome, len(d.Keys))
+		}
+		for _, key := range d.Keys {
+			owner, ok := ls.Users[key]
+			if _, stored := ls.Mem[key]; !stored {
+				outcomes[d.User][key] = handler.OutcomeNotFound
+				continue
+			}
+			if !ok || owner != d.User {
+				outcomes[d.User][key] = handler.OutcomeNotOwned
+				continue
+			}
+			outcomes[d.User][key] = handler.OutcomeDeleted
+			if !ls.Removed[key] && !removing[key] {
+				r.Links = append(r.Links, entry{Key: key, User: d.User, RemovedAt: &now})
+				removing[key] = true
+			}
+		}
+	}
+	if len(r.Links) == 0 {
+		return outcomes, nil
+	}
+	if err := ls.commit(r); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+func (ls *LinkStore) Restore(ctx context.Context, urls []string, user string, since time.Time) (map[string]handler.DeleteOutcome, error) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	outcomes := make(map[string]handler.DeleteOutcome, len(urls))
+	now := time.Now()
+	r := record{Op: opRestore}
+	restoring := make(map[string]bool)
+	for _, key := range urls {
+		owner, ok := ls.Users[key]
+		dk, dedup := ls.dedupKey(owner, ls.Mem[key])
+		_, held := ls.holder(dk)
+		switch {
+		case !ok:
+			outcomes[key] = handler.OutcomeNotFound
+		case owner != user:
+			outcomes[key] = handler.OutcomeNotOwned
+		case ls.Removed[key] && ls.RemovedAt[key].Before(since):
+			// past the retention, waiting to be purged
+			outcomes[key] = handler.OutcomeNotFound
+		case ls.expired(key, now):
+			outcomes[key] = handler.OutcomeExpired
+		case ls.Removed[key] && dedup && (held || restoring[dk]):
+			// the url was shortened again after the deletion
+			outcomes[key] = handler.OutcomeConflict
+		default:
+			outcomes[key] = handler.OutcomeRestored
+			if ls.Removed[key] {
+				r.Links = append(r.Links, entry{Key: key, User: user})
+				restoring[dk] = true
+			}
+		}
+	}
+	if len(r.Links) == 0 {
+		return outcomes, nil
+	}
+	if err := ls.commit(r); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// Purge forgets the links removed before the given time, so their urls can
+// be shortened again, and returns how many of them were purged.
+func (ls *LinkStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	r := record{Op: opPurge}
+	for key := range ls.Removed {
+		if at, ok := ls.RemovedAt[key]; ok && at.Before(before) {
+			r.Links = append(r.Links, entry{Key: key})
+		}
+	}
+	if len(r.Links) == 0 {
+		return 0, nil
+	}
+	if err := ls.commit(r); err != nil {
+		return 0, err
+	}
+	return int64(len(r.Links)), nil
+}
+
 func (ls *LinkStore) Ping(ctx context.Context) error {
 	return nil
 }
 
-func (ls *LinkStore) Host() string {
-	u, err := url.Parse(ls.BaseURL)
-	if err != nil {
-		return ls.BaseURL
+// Writable checks that the journal can be written, it is always nil for a
+// store without a file.
+func (ls *LinkStore) Writable(ctx context.Context) error {
+	if ls.journal == nil {
+		return nil
 	}
-	return u.Host
+	return ls.journal.Writable()
+}
+
+func (ls *LinkStore) ShortURL(key string) string {
+	return ls.BaseURL.ShortURL(key)
 }
 
-func (ls *LinkStore) Create(ctx context.Context, lnk string, user string) (string, error) {
+func (ls *LinkStore) Create(ctx context.Context, lnk handler.Link, user string) (string, error) {
 	ls.Lock()
 	defer ls.Unlock()
 
@@ -59,12 +472,89 @@ func (ls *LinkStore) Create(ctx context.Context, lnk string, user string) (strin
 	default:
 	}
 
-	key := utils.RandString(ls.KeyLength)
-	ls.Mem[key] = lnk
-	ls.Users[key] = user
+	if lnk.URL == "" {
+		return "", handler.ErrInvalidURL
+	}
+	if lnk.Alias != "" {
+		if err := handler.ValidateAlias(lnk.Alias); err != nil {
+			return "", err
+		}
+		if _, ok := ls.Mem[lnk.Alias]; ok {
+			if ls.duplicate(lnk.Alias, user, lnk.URL) {
+				return "", &handler.ConflictError{Key: lnk.Alias}
+			}
+			return "", fmt.Errorf("%w: %s", handler.ErrAliasTaken, lnk.Alias)
+		}
+	}
+	if dk, ok := ls.dedupKey(user, lnk.URL); ok {
+		if key, ok := ls.holder(dk); ok {
+			return "", &handler.ConflictError{Key: key}
+		}
+	}
+
+	key := lnk.Alias
+	if key == "" {
+		var err error
+		if key, err = ls.newKey(lnk.URL, user, nil); err != nil {
+			return "", err
+		}
+	}
+	err := ls.commit(record{
+		Op:    opCreate,
+		Seq:   ls.Seq,
+		Links: []entry{{Key: key, URL: lnk.URL, User: user, ExpiresAt: lnk.ExpiresAt, CreatedAt: time.Now().UTC()}},
+	})
+	if err != nil {
+		return "", err
+	}
+	ls.created(1)
 	return key, nil
 }
 
+// created reports n new links to the hooks.
+func (ls *LinkStore) created(n int) {
+	if ls.Hooks != nil {
+		ls.Hooks.LinksCreated(n)
+	}
+}
+
+// newKey returns a new key for lnk of user that is neither stored nor in
+// taken. A key that holds the same link already, as a hash key of a link
+// created again does, is reported as a conflict.
+func (ls *LinkStore) newKey(lnk string, user string, taken map[string]bool) (string, error) {
+	if ls.Keys == nil {
+		keys, err := Config{KeyLength: ls.KeyLength}.KeyGenerator()
+		if err != nil {
+			return "", err
+		}
+		ls.Keys = keys
+	}
+	in := utils.KeyInput{URL: lnk, User: user, Next: ls.next}
+	for attempt := 0; ; attempt++ {
+		key, err := ls.Keys.NewKey(in, attempt)
+		if err != nil {
+			return "", err
+		}
+		if taken[key] || handler.ReservedKey(key) {
+			continue
+		}
+		stored, ok := ls.Mem[key]
+		if !ok {
+			return key, nil
+		}
+		if ls.Users[key] == user && ls.holds(key) && handler.CanonicalURL(stored) == handler.CanonicalURL(lnk) {
+			return "", &handler.ConflictError{Key: key}
+		}
+	}
+}
+
+// next advances the counter of sequential keys, which is journaled with
+// the links created.
+func (ls *LinkStore) next() (uint64, error) {
+	ls.Seq++
+	return ls.Seq, nil
+}
+
 func (ls *LinkStore) Get(ctx context.Context, key string) (string, error) {
 	ls.Lock()
 	defer ls.Unlock()
@@ -75,61 +565,270 @@ func (ls *LinkStore) Get(ctx context.Context, key string) (string, error) {
 	default:
 	}
 	lnk, ok := ls.Mem[key]
-	if ok {
-		return lnk, nil
+	if !ok {
+		return "", handler.ErrNotFound
 	}
-	return "", sql.ErrNoRows
+	if ls.Removed[key] {
+		return "", handler.ErrGone
+	}
+	if ls.expired(key, time.Now()) {
+		return "", fmt.Errorf("%w: expired", handler.ErrGone)
+	}
+	return lnk, nil
 }
 
-func (ls *LinkStore) GetURLList(ctx context.Context, u string) ([]handler.Item, error) {
+func (ls *LinkStore) GetURLList(ctx context.Context, u string, q handler.ListQuery) ([]handler.Item, *handler.Cursor, error) {
 	ls.Lock()
 	defer ls.Unlock()
 
 	select {
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return nil, nil, ctx.Err()
 	default:
 	}
 
+	keys := ls.userIndex()[u]
+	filter := strings.ToLower(q.Filter)
+	now := time.Now()
 	result := make([]handler.Item, 0)
 
-	for lnk, user := range ls.Users {
-		if user == u {
-			shortURL := &url.URL{
-				Scheme: "http",
-				Host:   ls.Host(),
-				Path:   lnk,
+	// keys are ordered, so the page starts right after the cursor
+	i, step := 0, 1
+	if q.Desc {
+		i, step = len(keys)-1, -1
+	}
+	if q.Cursor != nil {
+		pos := sort.Search(len(keys), func(n int) bool {
+			return !q.Cursor.Before(ls.Created[keys[n]], keys[n])
+		})
+		if q.Desc {
+			i = pos - 1
+		} else {
+			i = pos
+			if pos < len(keys) && keys[pos] == q.Cursor.Key {
+				i++
 			}
-			result = append(result,
-				handler.Item{
-					ShortURL: shortURL.String(),
-					URL:      ls.Mem[lnk],
-				},
-			)
 		}
 	}
 
-	if len(result) == 0 {
-		return nil, sql.ErrNoRows
+	for ; i >= 0 && i < len(keys) && len(result) <= q.Limit; i += step {
+		key := keys[i]
+		lnk := ls.Mem[key]
+		deleted := ls.Removed[key] || ls.expired(key, now)
+		if deleted && !q.IncludeDeleted {
+			continue
+		}
+		if filter != "" && !strings.Contains(strings.ToLower(lnk), filter) {
+			continue
+		}
+		result = append(result,
+			handler.Item{
+				Key:       key,
+				ShortURL:  ls.ShortURL(key),
+				URL:       lnk,
+				CreatedAt: ls.createdAt(key),
+				ExpiresAt: ls.expiresAt(key),
+				Deleted:   deleted,
+				DeletedAt: ls.deletedAt(key, now),
+			},
+		)
 	}
 
-	return result, nil
+	if len(result) > q.Limit {
+		result = result[:q.Limit]
+		return result, handler.CursorOf(result[q.Limit-1]), nil
+	}
+	return result, nil, nil
 }
 
+// Batch stores all links of the batch or none of them: a link that is
+// already stored, or repeated within the batch, fails the whole batch.
 func (ls *LinkStore) Batch(ctx context.Context, batch []handler.BatchItem, user string) ([]handler.ResultItem, error) {
-	return nil, nil
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	seen := make(map[string]bool, len(batch))
+	aliases := make(map[string]bool)
+	for _, i := range batch {
+		if i.URL == "" {
+			return nil, fmt.Errorf("%w: %s", handler.ErrInvalidURL, i.ID)
+		}
+		if dk, ok := ls.dedupKey(user, i.URL); ok {
+			if _, ok := ls.holder(dk); ok || seen[dk] {
+				return nil, fmt.Errorf("%w: %s", handler.ErrConflict, i.URL)
+			}
+			seen[dk] = true
+		}
+		if i.Alias == "" {
+			continue
+		}
+		if err := handler.ValidateAlias(i.Alias); err != nil {
+			return nil, err
+		}
+		if _, ok := ls.Mem[i.Alias]; ok || aliases[i.Alias] {
+			return nil, fmt.Errorf("%w: %s", handler.ErrAliasTaken, i.Alias)
+		}
+		aliases[i.Alias] = true
+	}
+
+	r := record{Op: opCreate, Links: make([]entry, 0, len(batch))}
+	now := time.Now().UTC()
+	for _, i := range batch {
+		key := i.Alias
+		if key == "" {
+			var err error
+			if key, err = ls.newKey(i.URL, user, aliases); err != nil {
+				return nil, err
+			}
+			aliases[key] = true
+		}
+		r.Links = append(r.Links, entry{Key: key, URL: i.URL, User: user, ExpiresAt: i.ExpiresAt, CreatedAt: now})
+	}
+	r.Seq = ls.Seq
+	if err := ls.commit(r); err != nil {
+		return nil, err
+	}
+
+	res := make([]handler.ResultItem, 0, len(batch))
+	for n, i := range batch {
+		key := r.Links[n].Key
+		res = append(res, handler.ResultItem{ID: i.ID, URL: ls.ShortURL(key)})
+	}
+
+	ls.created(len(res))
+	return res, nil
+}
+
+func (ls *LinkStore) Find(ctx context.Context, lnk string, user string) (string, error) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	if dk, ok := ls.dedupKey(user, lnk); ok {
+		if key, ok := ls.holder(dk); ok {
+			return key, nil
+		}
+	}
+	return "", handler.ErrNotFound
 }
 
-func (ls *LinkStore) Find(ctx context.Context, lnk string) (string, error) {
-	return "", nil
+func (ls *LinkStore) expired(key string, now time.Time) bool {
+	at, ok := ls.Expires[key]
+	return ok && !at.After(now)
 }
 
-func (ls *LinkStore) Save() error {
-	if err := MapToFile(ls.Mem, ls.File); err != nil {
-		return err
+func (ls *LinkStore) createdAt(key string) *time.Time {
+	if at, ok := ls.Created[key]; ok {
+		return &at
 	}
-	if err := MapToFile(ls.Users, ls.File+".users"); err != nil {
-		return err
+	return nil
+}
+
+func (ls *LinkStore) expiresAt(key string) *time.Time {
+	if at, ok := ls.Expires[key]; ok {
+		return &at
+	}
+	return nil
+}
+
+// deletedAt returns the time key was removed or, when it expired without
+// being swept yet, the time it expired at.
+func (ls *LinkStore) deletedAt(key string, now time.Time) *time.Time {
+	if at := ls.removedAt(key); at != nil {
+		return at
+	}
+	if ls.expired(key, now) {
+		return ls.expiresAt(key)
+	}
+	return nil
+}
+
+func (ls *LinkStore) removedAt(key string) *time.Time {
+	if at, ok := ls.RemovedAt[key]; ok && ls.Removed[key] {
+		return &at
 	}
 	return nil
 }
+
+// ExpireLinks marks links expired by now as removed and returns how many
+// of them were marked.
+func (ls *LinkStore) ExpireLinks(ctx context.Context, now time.Time) (int64, error) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	at := now.UTC()
+	r := record{Op: opDelete}
+	for key := range ls.Expires {
+		if ls.expired(key, now) && !ls.Removed[key] {
+			r.Links = append(r.Links, entry{Key: key, User: ls.Users[key], RemovedAt: &at})
+		}
+	}
+	if len(r.Links) == 0 {
+		return 0, nil
+	}
+	if err := ls.commit(r); err != nil {
+		return 0, err
+	}
+	return int64(len(r.Links)), nil
+}
+
+// Compact rewrites the journal so that it holds one entry per stored link.
+func (ls *LinkStore) Compact() error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if ls.journal == nil {
+		return nil
+	}
+	recs := make([]record, 0, len(ls.Mem)/snapshotChunk+1)
+	r := record{Op: opCreate, Seq: ls.Seq}
+	for key, lnk := range ls.Mem {
+		r.Links = append(r.Links, entry{
+			Key:       key,
+			URL:       lnk,
+			User:      ls.Users[key],
+			Removed:   ls.Removed[key],
+			ExpiresAt: ls.expiresAt(key),
+			CreatedAt: ls.Created[key],
+			RemovedAt: ls.removedAt(key),
+		})
+		if len(r.Links) == snapshotChunk {
+			recs = append(recs, r)
+			r = record{Op: opCreate}
+		}
+	}
+	if len(r.Links) != 0 || r.Seq != 0 {
+		recs = append(recs, r)
+	}
+	recs = append(recs, ls.clickSnapshot()...)
+	return ls.journal.Compact(recs)
+}
+
+// Close compacts and closes the journal.
+func (ls *LinkStore) Close() error {
+	if ls.journal == nil {
+		return nil
+	}
+	if err := ls.Compact(); err != nil {
+		ls.journal.Close()
+		return err
+	}
+	return ls.journal.Close()
+}
@@ -2,8 +2,15 @@ package store
 
 import (
 	"context"
+	"errors"
+	"github.com/AlLevykin/cutwell/internal/api/handler"
+	"github.com/AlLevykin/cutwell/internal/app/linkstest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLinkStore_Create(t *testing.T) {
@@ -62,7 +69,7 @@ func TestLinkStore_Create(t *testing.T) {
 				Users:     tt.fields.users,
 				KeyLength: tt.fields.keyLen,
 			}
-			got, err := ls.Create(ctx, tt.args.lnk, tt.args.u)
+			got, err := ls.Create(ctx, handler.Link{URL: tt.args.lnk}, tt.args.u)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Create() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -148,8 +155,12 @@ func TestNewLinkStore(t *testing.T) {
 			&LinkStore{
 				Mem:       make(map[string]string),
 				Users:     make(map[string]string),
+				Removed:   make(map[string]bool),
+				Expires:   make(map[string]time.Time),
+				Created:   make(map[string]time.Time),
+				RemovedAt: make(map[string]time.Time),
 				KeyLength: 9,
-				BaseURL:   "127.0.0.1:8080",
+				BaseURL:   testBaseURL,
 			},
 		},
 	}
@@ -157,18 +168,22 @@ func TestNewLinkStore(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			cfg := Config{
 				KeyLength: tt.keyLength,
-				BaseURL:   "127.0.0.1:8080",
+				BaseURL:   testBaseURL,
 			}
-			if got := NewLinkStore(cfg, ""); !reflect.DeepEqual(got, tt.want) {
+			got, err := NewLinkStore(cfg, "")
+			if err != nil {
+				t.Fatalf("NewLinkStore() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewLinkStore() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestLinkStore_Host(t *testing.T) {
+func TestLinkStore_ShortURL(t *testing.T) {
 	type fields struct {
-		BaseURL string
+		BaseURL handler.BaseURL
 	}
 	tests := []struct {
 		name   string
@@ -177,13 +192,18 @@ func TestLinkStore_Host(t *testing.T) {
 	}{
 		{
 			"Host",
-			fields{"127.0.0.1:8080"},
-			"127.0.0.1:8080",
+			fields{testBaseURL},
+			"http://127.0.0.1:8080/key",
 		},
 		{
-			"Host",
-			fields{"http://127.0.0.1:8080"},
-			"127.0.0.1:8080",
+			"Scheme",
+			fields{handler.BaseURL{Scheme: "https", Host: "127.0.0.1:8080"}},
+			"https://127.0.0.1:8080/key",
+		},
+		{
+			"Prefix",
+			fields{handler.BaseURL{Scheme: "https", Host: "go.example.com", Prefix: "/s"}},
+			"https://go.example.com/s/key",
 		},
 	}
 	for _, tt := range tests {
@@ -191,9 +211,298 @@ func TestLinkStore_Host(t *testing.T) {
 			ls := &LinkStore{
 				BaseURL: tt.fields.BaseURL,
 			}
-			if got := ls.Host(); got != tt.want {
-				t.Errorf("Host() = %v, want %v", got, tt.want)
+			if got := ls.ShortURL("key"); got != tt.want {
+				t.Errorf("ShortURL() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestLinkStore_Find(t *testing.T) {
+	tests := []struct {
+		name    string
+		dedup   handler.DedupScope
+		lnk     string
+		user    string
+		want    string
+		wantErr bool
+	}{
+		{"ok", "", "http://ya.ru/Path", "000001", "1", false},
+		{"case insensitive host", "", "HTTP://YA.RU/Path", "000001", "1", false},
+		{"case sensitive path", "", "http://ya.ru/path", "000001", "", true},
+		{"global", handler.DedupGlobal, "http://ya.ru/Path", "000002", "1", false},
+		{"user", handler.DedupUser, "http://ya.ru/Path", "000001", "1", false},
+		{"other user", handler.DedupUser, "http://ya.ru/Path", "000002", "", true},
+		{"none", handler.DedupNone, "http://ya.ru/Path", "000001", "", true},
+		{"no rows error", "", "google.com", "000001", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := &LinkStore{
+				Mem:   map[string]string{"1": "http://ya.ru/Path"},
+				Users: map[string]string{"1": "000001"},
+				Dedup: tt.dedup,
+			}
+			got, err := ls.Find(context.Background(), tt.lnk, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Find() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Find() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkStore_Batch(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   []handler.BatchItem
+		wantErr error
+	}{
+		{
+			"ok",
+			[]handler.BatchItem{{ID: "a", URL: "google.com"}, {ID: "b", URL: "yandex.ru"}},
+			nil,
+		},
+		{
+			"stored link",
+			[]handler.BatchItem{{ID: "a", URL: "google.com"}, {ID: "b", URL: "ya.ru"}},
+			handler.ErrConflict,
+		},
+		{
+			"repeated link",
+			[]handler.BatchItem{{ID: "a", URL: "google.com"}, {ID: "b", URL: "google.com"}},
+			handler.ErrConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := &LinkStore{
+				Mem:       map[string]string{"1": "ya.ru"},
+				Users:     map[string]string{"1": "000001"},
+				KeyLength: 9,
+			}
+			got, err := ls.Batch(context.Background(), tt.batch, "000002")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Batch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(ls.Mem) != 1 {
+					t.Errorf("Batch() stored %d links of a failed batch", len(ls.Mem)-1)
+				}
+				return
+			}
+			if len(got) != len(tt.batch) {
+				t.Fatalf("Batch() got %d items, want %d", len(got), len(tt.batch))
+			}
+			for i, item := range got {
+				if item.ID != tt.batch[i].ID {
+					t.Errorf("Batch() got id %v, want %v", item.ID, tt.batch[i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkStore_Delete(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		wantErr bool
+	}{
+		{"owner", "000001", true},
+		{"other user", "000002", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := &LinkStore{
+				Mem:   map[string]string{"1": "ya.ru"},
+				Users: map[string]string{"1": "000001"},
+			}
+			if _, err := ls.Delete(context.Background(), []string{"1", "2"}, tt.user); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			_, err := ls.Get(context.Background(), "1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLinkStore_Conformance(t *testing.T) {
+	linkstest.Run(t, func(t *testing.T, o linkstest.Options) handler.Links {
+		ls, err := NewLinkStore(Config{KeyLength: 9, BaseURL: testBaseURL, Dedup: o.Dedup, Keys: o.Keys}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ls
+	})
+}
+
+func TestLinkStore_FileConformance(t *testing.T) {
+	linkstest.Run(t, func(t *testing.T, o linkstest.Options) handler.Links {
+		ls, err := NewLinkStore(Config{KeyLength: 9, BaseURL: testBaseURL, Dedup: o.Dedup, Keys: o.Keys},
+			filepath.Join(t.TempDir(), "links"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			ls.Close()
+		})
+		return ls
+	})
+}
+
+func TestLinkStore_ExpireLinks(t *testing.T) {
+	now := time.Now()
+	ls := &LinkStore{
+		Mem:     map[string]string{"1": "ya.ru", "2": "google.com", "3": "mail.ru"},
+		Users:   map[string]string{"1": "000001", "2": "000001", "3": "000001"},
+		Removed: map[string]bool{},
+		Expires: map[string]time.Time{"1": now.Add(-time.Minute), "2": now.Add(time.Minute)},
+	}
+	got, err := ls.ExpireLinks(context.Background(), now)
+	if err != nil {
+		t.Fatalf("ExpireLinks() error = %v", err)
+	}
+	if got != 1 || !ls.Removed["1"] || ls.Removed["2"] || ls.Removed["3"] {
+		t.Errorf("ExpireLinks() = %v, removed %v", got, ls.Removed)
+	}
+}
+
+func TestLinkStore_RecordClicks(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+
+	ls := openStore(t, fileName)
+	key, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2022, 7, 30, 12, 0, 0, 0, time.UTC)
+	clicks := []handler.Click{
+		{Key: key, At: day.Add(-24 * time.Hour), Referrer: "google.com", UserAgent: "curl/7.79.1", IPHash: "c0ffee"},
+		{Key: key, At: day, Referrer: "google.com", UserAgent: "curl/7.79.1", IPHash: "c0ffee"},
+		{Key: key, At: day, IPHash: "decade"},
+	}
+	if err := ls.RecordClicks(ctx, clicks); err != nil {
+		t.Fatal(err)
+	}
+	want := &handler.Stats{
+		Total:    3,
+		Visitors: 2,
+		Daily:    []handler.DailyClicks{{Date: "2022-07-30", Clicks: 2}},
+		Referrers: []handler.ReferrerCount{
+			{Referrer: "google.com", Clicks: 2},
+			{Referrer: "", Clicks: 1},
+		},
+		UserAgents: []handler.UserAgentCount{
+			{UserAgent: "curl/7.79.1", Clicks: 2},
+			{UserAgent: "", Clicks: 1},
+		},
+	}
+	check := func(when string) {
+		t.Helper()
+		got, err := ls.Stats(ctx, key, "000001", day)
+		if err != nil {
+			t.Fatalf("Stats() %s error = %v", when, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Stats() %s got = %+v, want %+v", when, got, want)
+		}
+	}
+
+	// the clicks must survive a crash and then a compaction, which rolls
+	// them up into a single record
+	ls = openStore(t, fileName)
+	check("after replay")
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 2 {
+		t.Errorf("Compact() left %d records, want 2", lines)
+	}
+	ls = openStore(t, fileName)
+	defer ls.Close()
+	check("after compaction")
+	if err := ls.RecordClicks(ctx, clicks[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	want.Total, want.Daily[0].Clicks, want.Referrers[0].Clicks, want.UserAgents[0].Clicks = 4, 3, 3, 3
+	check("after compaction and a click")
+}
+
+func TestLinkStore_Purge(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "links")
+	ctx := context.Background()
+
+	ls := openStore(t, fileName)
+	purged, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := ls.Create(ctx, handler.Link{URL: "google.com"}, "000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Delete(ctx, []string{purged}, "000001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.RecordClicks(ctx, []handler.Click{{Key: purged, At: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ls.Purge(ctx, time.Now().Add(time.Minute))
+	if err != nil || got != 1 {
+		t.Fatalf("Purge() = %v, %v, want 1", got, err)
+	}
+
+	// the purge must survive a crash
+	ls = openStore(t, fileName)
+	defer ls.Close()
+	if _, err := ls.Get(ctx, purged); !errors.Is(err, handler.ErrNotFound) {
+		t.Errorf("Get() of purged link error = %v, want %v", err, handler.ErrNotFound)
+	}
+	if _, err := ls.Get(ctx, kept); err != nil {
+		t.Errorf("Get() of kept link error = %v", err)
+	}
+	if _, ok := ls.clicks[purged]; ok {
+		t.Errorf("Purge() kept the clicks of %s", purged)
+	}
+	if _, err := ls.Create(ctx, handler.Link{URL: "ya.ru"}, "000002"); err != nil {
+		t.Errorf("Create() of purged url error = %v", err)
+	}
+}
+
+type createdCounter int
+
+func (c *createdCounter) LinksCreated(n int) {
+	*c += createdCounter(n)
+}
+
+func TestLinkStore_Hooks(t *testing.T) {
+	var created createdCounter
+	ls, err := NewLinkStore(Config{KeyLength: 9, BaseURL: testBaseURL, Hooks: &created}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru"}, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ls.Create(ctx, handler.Link{URL: "http://ya.ru"}, "user"); err == nil {
+		t.Fatal("Create() of a duplicate: want error")
+	}
+	if _, err = ls.Batch(ctx, []handler.BatchItem{{ID: "a", URL: "http://go.dev"}, {ID: "b", URL: "http://golang.org"}}, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if created != 3 {
+		t.Errorf("LinksCreated() got %d links, want 3", created)
+	}
+}
@@ -5,26 +5,30 @@ import (
 	"os"
 )
 
+// FileToMap reads a map dumped as a single JSON object. It is only used to
+// import files written before the store switched to a journal.
 func FileToMap(fileName string) map[string]string {
 	var m map[string]string
-	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0777)
-	if err != nil {
+	if err := decodeFile(fileName, &m); err != nil || m == nil {
 		m = make(map[string]string)
-		return m
 	}
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&m); err != nil {
-		m = make(map[string]string)
-		return m
+	return m
+}
+
+// FileToBoolMap is FileToMap of a map of flags.
+func FileToBoolMap(fileName string) map[string]bool {
+	var m map[string]bool
+	if err := decodeFile(fileName, &m); err != nil || m == nil {
+		m = make(map[string]bool)
 	}
 	return m
 }
 
-func MapToFile(m map[string]string, fileName string) error {
-	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0777)
+func decodeFile(fileName string, v interface{}) error {
+	file, err := os.Open(fileName)
 	if err != nil {
 		return err
 	}
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(&m)
+	defer file.Close()
+	return json.NewDecoder(file).Decode(v)
 }
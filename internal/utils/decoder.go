@@ -3,49 +3,76 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 )
 
-const UserPassword = "qwertyQWERTY"
+var ErrMalformedMessage = errors.New("malformed message")
 
+// Decoder seals and opens messages with AES-GCM. It holds an ordered
+// keyring: the first key is the newest one and is used for encoding, the
+// rest are only accepted when decoding so secrets can be rotated without
+// invalidating messages sealed with the previous ones.
 type Decoder struct {
-	aesgcm cipher.AEAD
-	nonce  []byte
+	keys []cipher.AEAD
 }
 
-func NewDecoder() *Decoder {
-	key := sha256.Sum256([]byte(UserPassword))
-
-	aesblock, err := aes.NewCipher(key[:])
-	if err != nil {
+// NewDecoder builds a keyring from the given secrets, newest first.
+func NewDecoder(secrets ...string) *Decoder {
+	if len(secrets) == 0 {
 		return nil
 	}
-	aesgcm, err := cipher.NewGCM(aesblock)
-	if err != nil {
-		return nil
+	keys := make([]cipher.AEAD, 0, len(secrets))
+	for _, s := range secrets {
+		key := sha256.Sum256([]byte(s))
+
+		aesblock, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil
+		}
+		aesgcm, err := cipher.NewGCM(aesblock)
+		if err != nil {
+			return nil
+		}
+		keys = append(keys, aesgcm)
 	}
-	nonce := key[len(key)-aesgcm.NonceSize():]
 
 	return &Decoder{
-		aesgcm: aesgcm,
-		nonce:  nonce,
+		keys: keys,
 	}
 }
 
-func (d *Decoder) Encode(userID string) string {
-	return hex.EncodeToString(d.aesgcm.Seal(nil, d.nonce, []byte(userID), nil))
+// Encode seals userID with the newest key. A fresh random nonce is
+// generated for every message and prepended to the ciphertext.
+func (d *Decoder) Encode(userID string) (string, error) {
+	aesgcm := d.keys[0]
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(aesgcm.Seal(nonce, nonce, []byte(userID), nil)), nil
 }
 
+// Decode opens msg with the first key of the keyring that authenticates it.
 func (d *Decoder) Decode(msg string) (string, error) {
 	msgBytes, err := hex.DecodeString(msg)
 	if err != nil {
 		return "", err
 	}
 
-	decoded, err := d.aesgcm.Open(nil, d.nonce, msgBytes, nil)
-	if err != nil {
-		return "", err
+	err = ErrMalformedMessage
+	for _, aesgcm := range d.keys {
+		ns := aesgcm.NonceSize()
+		if len(msgBytes) < ns+aesgcm.Overhead() {
+			continue
+		}
+		var decoded []byte
+		decoded, err = aesgcm.Open(nil, msgBytes[:ns], msgBytes[ns:], nil)
+		if err == nil {
+			return string(decoded), nil
+		}
 	}
-	return string(decoded), nil
+	return "", err
 }
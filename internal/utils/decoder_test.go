@@ -4,20 +4,45 @@ import (
 	"testing"
 )
 
+const testSecret = "qwertyQWERTY"
+
 func TestDecoder_Decode(t *testing.T) {
+	d := NewDecoder(testSecret)
+	hello, err := d.Encode("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := NewDecoder("old secret").Encode("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := NewDecoder("foreign secret").Encode("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(hello)
+	if tampered[len(tampered)-1] == '0' {
+		tampered[len(tampered)-1] = '1'
+	} else {
+		tampered[len(tampered)-1] = '0'
+	}
 	tests := []struct {
 		name    string
 		arg     string
 		want    string
 		wantErr bool
 	}{
-		{"Hello", "a4aa1685e126ea2d3f6f960cc00f7af5949340d8d7", "Hello", false},
+		{"Hello", hello, "Hello", false},
+		{"Old key", old, "Hello", false},
+		{"Foreign key", foreign, "", true},
+		{"Tampered", string(tampered), "", true},
+		{"Short", "a4aa", "", true},
 		{"Error", "Error", "", true},
 	}
-	d := NewDecoder()
+	rotated := NewDecoder(testSecret, "old secret")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := d.Decode(tt.arg)
+			got, err := rotated.Decode(tt.arg)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Decode() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -33,15 +58,26 @@ func TestDecoder_Encode(t *testing.T) {
 	tests := []struct {
 		name string
 		arg  string
-		want string
 	}{
-		{"Hello", "Hello", "a4aa1685e126ea2d3f6f960cc00f7af5949340d8d7"},
+		{"Hello", "Hello"},
+		{"Empty", ""},
 	}
-	d := NewDecoder()
+	d := NewDecoder(testSecret, "old secret")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := d.Encode(tt.arg); got != tt.want {
-				t.Errorf("Encode() = %v, want %v", got, tt.want)
+			first, err := d.Encode(tt.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := d.Encode(tt.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == second {
+				t.Errorf("Encode() reused nonce: %v", first)
+			}
+			if got, err := NewDecoder(testSecret).Decode(first); err != nil || got != tt.arg {
+				t.Errorf("Encode() not sealed with newest key: %v, %v", got, err)
 			}
 		})
 	}
@@ -49,14 +85,18 @@ func TestDecoder_Encode(t *testing.T) {
 
 func TestNewDecoder(t *testing.T) {
 	tests := []struct {
-		name string
+		name    string
+		secrets []string
+		wantNil bool
 	}{
-		{"constructor"},
+		{"constructor", []string{testSecret}, false},
+		{"keyring", []string{testSecret, "old secret"}, false},
+		{"no secrets", nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewDecoder(); got == nil {
-				t.Errorf("NewDecoder() = %v, want %v", got, "not nil value")
+			if got := NewDecoder(tt.secrets...); (got == nil) != tt.wantNil {
+				t.Errorf("NewDecoder() = %v, want nil %v", got, tt.wantNil)
 			}
 		})
 	}
@@ -1,17 +1,169 @@
 package utils
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
 )
 
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+// DefaultAlphabet is the alphabet of random strings when none is configured.
+const DefaultAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+const (
+	// MaxKeyLength is the longest key a generator makes, the longest key
+	// the stores accept.
+	MaxKeyLength = 64
+	// DefaultGrowAfter is the number of collisions in a row after which a
+	// generator makes longer keys.
+	DefaultGrowAfter = 3
+	// keyAttempts bounds the keys generated for a single link.
+	keyAttempts = 10
+)
+
+var ErrKeyspaceFull = errors.New("no free keys left")
+
+// RandString returns a random string of n characters of DefaultAlphabet.
 func RandString(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+	s, err := stringFrom(rand.Reader, DefaultAlphabet, n)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// stringFrom returns n characters of alphabet read from src. Bytes that
+// would make some characters more likely than the others are skipped.
+func stringFrom(src io.Reader, alphabet string, n int) (string, error) {
+	m := len(alphabet)
+	limit := 256 - 256%m
+	res := make([]byte, 0, n)
+	buf := make([]byte, n+n/4+1)
+	for len(res) < n {
+		if _, err := io.ReadFull(src, buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			if int(c) >= limit {
+				continue
+			}
+			res = append(res, alphabet[int(c)%m])
+			if len(res) == n {
+				break
+			}
+		}
+	}
+	return string(res), nil
+}
+
+// KeyInput is what a KeyGenerator can make the key of a link from.
+type KeyInput struct {
+	URL  string
+	User string
+	// Next returns the next value of the counter kept by the link store.
+	Next func() (uint64, error)
+}
+
+// KeyGenerator generates the keys of new links.
+type KeyGenerator interface {
+	// NewKey returns a key for the attempt-th try to store a link, tries
+	// after the first one follow collisions with stored keys.
+	NewKey(in KeyInput, attempt int) (string, error)
+}
+
+type RandomKeysConfig struct {
+	// Alphabet is the characters of keys, DefaultAlphabet when empty.
+	Alphabet string
+	// Length is the length of keys until the keyspace gets crowded.
+	Length int
+	// MaxLength bounds the growth of keys, MaxKeyLength when zero.
+	MaxLength int
+	// GrowAfter is the number of collisions in a row that makes keys one
+	// character longer, DefaultGrowAfter when zero.
+	GrowAfter int
+}
+
+// RandomKeys generates random keys. Collisions get likely as the keyspace
+// fills up, so when a link collides GrowAfter times in a row all the keys
+// generated afterwards are one character longer. The length is not stored,
+// after a restart it grows again as collisions happen.
+type RandomKeys struct {
+	alphabet  string
+	length    int32
+	maxLength int
+	growAfter int
+}
+
+// withDefaults fills in the defaults of c and validates it.
+func (c RandomKeysConfig) withDefaults() (RandomKeysConfig, error) {
+	if c.Alphabet == "" {
+		c.Alphabet = DefaultAlphabet
+	}
+	if c.MaxLength == 0 {
+		c.MaxLength = MaxKeyLength
+	}
+	if c.GrowAfter == 0 {
+		c.GrowAfter = DefaultGrowAfter
+	}
+	if err := validateAlphabet(c.Alphabet); err != nil {
+		return c, err
+	}
+	if c.Length < 1 || c.Length > c.MaxLength || c.MaxLength > MaxKeyLength {
+		return c, fmt.Errorf("key length %d must be 1 to %d", c.Length, c.MaxLength)
+	}
+	if c.GrowAfter < 1 {
+		return c, fmt.Errorf("invalid key grow after %d", c.GrowAfter)
+	}
+	return c, nil
+}
+
+func NewRandomKeys(c RandomKeysConfig) (*RandomKeys, error) {
+	c, err := c.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &RandomKeys{
+		alphabet:  c.Alphabet,
+		length:    int32(c.Length),
+		maxLength: c.MaxLength,
+		growAfter: c.GrowAfter,
+	}, nil
+}
+
+// validateAlphabet checks that the characters of alphabet are unique and
+// can be used in a url path and an alias.
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return fmt.Errorf("alphabet %q needs at least 2 characters", alphabet)
+	}
+	for i, r := range alphabet {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("alphabet %q may only contain letters, digits, '-' and '_'", alphabet)
+		}
+		if strings.IndexRune(alphabet[i+1:], r) != -1 {
+			return fmt.Errorf("alphabet %q repeats %q", alphabet, r)
+		}
+	}
+	return nil
+}
+
+// Length returns the current length of keys.
+func (g *RandomKeys) Length() int {
+	return int(atomic.LoadInt32(&g.length))
+}
+
+func (g *RandomKeys) NewKey(in KeyInput, attempt int) (string, error) {
+	if attempt >= keyAttempts {
+		return "", ErrKeyspaceFull
+	}
+	n := atomic.LoadInt32(&g.length)
+	if attempt > 0 && attempt%g.growAfter == 0 && int(n) < g.maxLength {
+		// other links may have grown the keys meanwhile, they only grow
+		// once per crowded link
+		atomic.CompareAndSwapInt32(&g.length, n, n+1)
+		n = atomic.LoadInt32(&g.length)
 	}
-	return string(b)
+	return stringFrom(rand.Reader, g.alphabet, int(n))
 }
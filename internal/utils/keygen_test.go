@@ -1,6 +1,10 @@
 package utils
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestRandString(t *testing.T) {
 	tests := []struct {
@@ -26,3 +30,62 @@ func TestRandString(t *testing.T) {
 		})
 	}
 }
+
+func TestRandString_Unique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		s := RandString(9)
+		if seen[s] {
+			t.Fatalf("RandString() repeated %q", s)
+		}
+		seen[s] = true
+	}
+}
+
+func TestNewRandomKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RandomKeysConfig
+		wantErr bool
+	}{
+		{"defaults", RandomKeysConfig{Length: 9}, false},
+		{"alphabet", RandomKeysConfig{Alphabet: "0123456789abcdef", Length: 9}, false},
+		{"zero length", RandomKeysConfig{}, true},
+		{"too long", RandomKeysConfig{Length: MaxKeyLength + 1}, true},
+		{"over max length", RandomKeysConfig{Length: 9, MaxLength: 8}, true},
+		{"short alphabet", RandomKeysConfig{Alphabet: "a", Length: 9}, true},
+		{"repeated alphabet", RandomKeysConfig{Alphabet: "abca", Length: 9}, true},
+		{"slash in alphabet", RandomKeysConfig{Alphabet: "ab/", Length: 9}, true},
+		{"negative grow after", RandomKeysConfig{Length: 9, GrowAfter: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRandomKeys(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("NewRandomKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRandomKeys_NewKey(t *testing.T) {
+	g, err := NewRandomKeys(RandomKeysConfig{Alphabet: "ab", Length: 4, MaxLength: 5, GrowAfter: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := g.NewKey(KeyInput{}, 0)
+	if err != nil || len(key) != 4 || strings.Trim(key, "ab") != "" {
+		t.Fatalf("NewKey() got = %q, %v", key, err)
+	}
+	if _, err = g.NewKey(KeyInput{}, 1); err != nil || g.Length() != 4 {
+		t.Fatalf("NewKey() grew after a single collision to %d", g.Length())
+	}
+	if key, err = g.NewKey(KeyInput{}, 2); err != nil || len(key) != 5 || g.Length() != 5 {
+		t.Fatalf("NewKey() got = %q, %v, want a longer key", key, err)
+	}
+	if key, _ = g.NewKey(KeyInput{}, 4); len(key) != 5 {
+		t.Errorf("NewKey() grew over the max length: %q", key)
+	}
+	if _, err = g.NewKey(KeyInput{}, keyAttempts); !errors.Is(err, ErrKeyspaceFull) {
+		t.Errorf("NewKey() error = %v, want %v", err, ErrKeyspaceFull)
+	}
+}
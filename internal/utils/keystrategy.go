@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Base62Alphabet is the alphabet of sequential keys when none is
+// configured, its characters are in ascending order, so sequential keys of
+// the same length sort like their numbers.
+const Base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+type KeyStrategy string
+
+const (
+	KeysRandom KeyStrategy = "random"
+	// KeysHash makes keys from a hash of the url and the user, so that a
+	// link created again gets the same key.
+	KeysHash KeyStrategy = "hash"
+	// KeysSequential makes short keys growing with the counter of the store.
+	KeysSequential KeyStrategy = "sequential"
+	// KeysObfuscated makes keys from the counter of the store that can't
+	// be enumerated without the salt.
+	KeysObfuscated KeyStrategy = "obfuscated"
+)
+
+type KeysConfig struct {
+	// Strategy is the kind of keys, KeysRandom when empty.
+	Strategy KeyStrategy
+	RandomKeysConfig
+	// Salt is the secret of hash and obfuscated keys.
+	Salt string
+}
+
+// NewKeyGenerator returns the generator of the configured strategy. Length,
+// MaxLength and GrowAfter apply to random and hash keys only, sequential
+// and obfuscated keys are as long as their numbers need.
+func NewKeyGenerator(c KeysConfig) (KeyGenerator, error) {
+	switch strings.ToLower(string(c.Strategy)) {
+	case "", string(KeysRandom):
+		return NewRandomKeys(c.RandomKeysConfig)
+	case string(KeysHash):
+		return NewHashKeys(c.RandomKeysConfig, c.Salt)
+	case string(KeysSequential):
+		return NewSequentialKeys(c.Alphabet)
+	case string(KeysObfuscated):
+		return NewObfuscatedKeys(c.Alphabet, c.Salt)
+	}
+	return nil, fmt.Errorf("unknown key strategy %q, want random, hash, sequential or obfuscated", c.Strategy)
+}
+
+type hashStream struct {
+	seed    []byte
+	counter uint32
+	buf     []byte
+}
+
+func (s *hashStream) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(s.buf) == 0 {
+			h := sha256.New()
+			h.Write(s.seed)
+			binary.Write(h, binary.BigEndian, s.counter)
+			s.buf = h.Sum(nil)
+			s.counter++
+		}
+		c := copy(p[n:], s.buf)
+		s.buf = s.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// HashKeys makes the key of a link from a hash of its url and user. The
+// tries after collisions hash the attempt too, and every GrowAfter of them
+// make keys one character longer, so the keys of a link are always the
+// same.
+type HashKeys struct {
+	cfg  RandomKeysConfig
+	salt string
+}
+
+func NewHashKeys(c RandomKeysConfig, salt string) (*HashKeys, error) {
+	c, err := c.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &HashKeys{cfg: c, salt: salt}, nil
+}
+
+func (g *HashKeys) NewKey(in KeyInput, attempt int) (string, error) {
+	if attempt >= keyAttempts {
+		return "", ErrKeyspaceFull
+	}
+	n := g.cfg.Length + attempt/g.cfg.GrowAfter
+	if n > g.cfg.MaxLength {
+		n = g.cfg.MaxLength
+	}
+	mac := hmac.New(sha256.New, []byte(g.salt))
+	fmt.Fprintf(mac, "%s\n%s\n%d", in.URL, in.User, attempt)
+	return stringFrom(&hashStream{seed: mac.Sum(nil)}, g.cfg.Alphabet, n)
+}
+
+// encodeNumber writes n in the positional system of alphabet, padded with
+// the first character of alphabet to width.
+func encodeNumber(n uint64, alphabet string, width int) string {
+	base := uint64(len(alphabet))
+	var b []byte
+	for n > 0 || len(b) == 0 {
+		b = append(b, alphabet[n%base])
+		n /= base
+	}
+	for len(b) < width {
+		b = append(b, alphabet[0])
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// SequentialKeys writes the counter of the store in the base of its
+// alphabet, keys are as short as they can be and can be enumerated.
+type SequentialKeys struct {
+	alphabet string
+}
+
+func NewSequentialKeys(alphabet string) (*SequentialKeys, error) {
+	if alphabet == "" {
+		alphabet = Base62Alphabet
+	}
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	return &SequentialKeys{alphabet: alphabet}, nil
+}
+
+func (g *SequentialKeys) NewKey(in KeyInput, attempt int) (string, error) {
+	if attempt >= keyAttempts {
+		return "", ErrKeyspaceFull
+	}
+	n, err := in.Next()
+	if err != nil {
+		return "", err
+	}
+	return encodeNumber(n, g.alphabet, 0), nil
+}
+
+const (
+	// obfuscatedBits is the size of the numbers of obfuscated keys, 2^40
+	// keys are a sparse enough space for the links of a shortener.
+	obfuscatedBits = 40
+	feistelRounds  = 4
+)
+
+// ObfuscatedKeys shuffles the counter of the store with a Feistel network
+// keyed by the salt, a permutation of all the numbers of obfuscatedBits
+// bits, and writes it in the base of its alphabet. Keys don't collide,
+// have the same length and the next key can't be told from the last one.
+type ObfuscatedKeys struct {
+	alphabet string
+	salt     []byte
+	width    int
+}
+
+func NewObfuscatedKeys(alphabet, salt string) (*ObfuscatedKeys, error) {
+	if alphabet == "" {
+		alphabet = Base62Alphabet
+	}
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if salt == "" {
+		return nil, fmt.Errorf("obfuscated keys need a salt")
+	}
+	return &ObfuscatedKeys{
+		alphabet: alphabet,
+		salt:     []byte(salt),
+		width:    len(encodeNumber(1<<obfuscatedBits-1, alphabet, 0)),
+	}, nil
+}
+
+func (g *ObfuscatedKeys) round(i int, half uint64) uint64 {
+	mac := hmac.New(sha256.New, g.salt)
+	binary.Write(mac, binary.BigEndian, [2]uint64{uint64(i), half})
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (g *ObfuscatedKeys) permute(n uint64) uint64 {
+	const halfBits = obfuscatedBits / 2
+	const mask = 1<<halfBits - 1
+	l, r := n>>halfBits, n&mask
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^g.round(i, r)&mask
+	}
+	return l<<halfBits | r
+}
+
+func (g *ObfuscatedKeys) NewKey(in KeyInput, attempt int) (string, error) {
+	if attempt >= keyAttempts {
+		return "", ErrKeyspaceFull
+	}
+	n, err := in.Next()
+	if err != nil {
+		return "", err
+	}
+	if n >= 1<<obfuscatedBits {
+		return "", ErrKeyspaceFull
+	}
+	return encodeNumber(g.permute(n), g.alphabet, g.width), nil
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// counter returns a KeyInput.Next counting from 1.
+func counter() func() (uint64, error) {
+	var n uint64
+	return func() (uint64, error) {
+		n++
+		return n, nil
+	}
+}
+
+func TestNewKeyGenerator(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  KeysConfig
+		want    string
+		wantErr bool
+	}{
+		{"default", KeysConfig{RandomKeysConfig: RandomKeysConfig{Length: 9}}, "*utils.RandomKeys", false},
+		{"hash", KeysConfig{Strategy: KeysHash, RandomKeysConfig: RandomKeysConfig{Length: 9}}, "*utils.HashKeys", false},
+		{"sequential", KeysConfig{Strategy: "Sequential"}, "*utils.SequentialKeys", false},
+		{"obfuscated", KeysConfig{Strategy: KeysObfuscated, Salt: "salt"}, "*utils.ObfuscatedKeys", false},
+		{"obfuscated without salt", KeysConfig{Strategy: KeysObfuscated}, "", true},
+		{"hash without length", KeysConfig{Strategy: KeysHash}, "", true},
+		{"unknown", KeysConfig{Strategy: "uuid"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewKeyGenerator(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewKeyGenerator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && fmt.Sprintf("%T", got) != tt.want {
+				t.Errorf("NewKeyGenerator() got %T, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashKeys_NewKey(t *testing.T) {
+	g, err := NewHashKeys(RandomKeysConfig{Length: 6, MaxLength: 7, GrowAfter: 2}, "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := KeyInput{URL: "http://ya.ru", User: "user"}
+	a, _ := g.NewKey(in, 0)
+	b, _ := g.NewKey(in, 0)
+	if len(a) != 6 || a != b {
+		t.Errorf("NewKey() got %q and %q, want the same key of 6 characters", a, b)
+	}
+	if c, _ := g.NewKey(KeyInput{URL: "http://ya.ru", User: "other"}, 0); c == a {
+		t.Errorf("NewKey() of another user got the same key %q", c)
+	}
+	if c, _ := g.NewKey(in, 1); c == a || len(c) != 6 {
+		t.Errorf("NewKey() after a collision got %q", c)
+	}
+	if c, _ := g.NewKey(in, 2); len(c) != 7 {
+		t.Errorf("NewKey() in a crowded keyspace got %q, want a longer key", c)
+	}
+	if c, _ := g.NewKey(in, 6); len(c) != 7 {
+		t.Errorf("NewKey() grew over the max length: %q", c)
+	}
+	other, _ := NewHashKeys(RandomKeysConfig{Length: 6}, "pepper")
+	if c, _ := other.NewKey(in, 0); c == a {
+		t.Errorf("NewKey() with another salt got the same key %q", c)
+	}
+}
+
+func TestSequentialKeys_NewKey(t *testing.T) {
+	g, err := NewSequentialKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := KeyInput{Next: counter()}
+	want := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "A"}
+	for _, w := range want {
+		if got, err := g.NewKey(in, 0); err != nil || got != w {
+			t.Fatalf("NewKey() got = %q, %v, want %q", got, err, w)
+		}
+	}
+	failing := KeyInput{Next: func() (uint64, error) {
+		return 0, errors.New("no counter")
+	}}
+	if _, err = g.NewKey(failing, 0); err == nil {
+		t.Error("NewKey() want the error of the counter")
+	}
+}
+
+func Test_encodeNumber(t *testing.T) {
+	tests := []struct {
+		n     uint64
+		width int
+		want  string
+	}{
+		{0, 0, "0"},
+		{61, 0, "z"},
+		{62, 0, "10"},
+		{62*62 - 1, 0, "zz"},
+		{5, 3, "005"},
+	}
+	for _, tt := range tests {
+		if got := encodeNumber(tt.n, Base62Alphabet, tt.width); got != tt.want {
+			t.Errorf("encodeNumber(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestObfuscatedKeys_NewKey(t *testing.T) {
+	g, err := NewObfuscatedKeys("", "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := KeyInput{Next: counter()}
+	seen := make(map[string]bool)
+	ascending := 0
+	prev := ""
+	for i := 0; i < 10000; i++ {
+		key, err := g.NewKey(in, 0)
+		if err != nil {
+			t.Fatalf("NewKey() error = %v", err)
+		}
+		if len(key) != 7 || seen[key] {
+			t.Fatalf("NewKey() got %q, want a new key of 7 characters", key)
+		}
+		if key > prev {
+			ascending++
+		}
+		seen[key] = true
+		prev = key
+	}
+	if ascending > 6000 {
+		t.Errorf("NewKey() got %d of 10000 keys in ascending order", ascending)
+	}
+	if _, err = g.NewKey(KeyInput{Next: func() (uint64, error) {
+		return 1 << obfuscatedBits, nil
+	}}, 0); !errors.Is(err, ErrKeyspaceFull) {
+		t.Errorf("NewKey() error = %v, want %v", err, ErrKeyspaceFull)
+	}
+}